@@ -0,0 +1,409 @@
+package prometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+const (
+	callbackPrefix    = "prometheus:"
+	startTimeInstance = "prometheus:start_time"
+	inFlightInstance  = "prometheus:in_flight" // the in-flight gauge incremented by before, SetLabel may replace the query metrics until after
+	traceIDLabel      = "trace_id"             // label of the exemplars of Config.TraceID
+
+	otherLabel = "other" // label of the tables not allowed by Config.TableAllowlist or Config.MaxTableLabels, of the sqls after Config.MaxSQLLabels and of the invalid label values
+)
+
+var (
+	operationNames  = []string{"create", "query", "update", "delete", "row", "raw"}
+	writeOperations = map[string]bool{"create": true, "update": true, "delete": true} // the operations RowsAffected is recorded for
+)
+
+// QueryMetrics are recorded by the callbacks registered if Config.InstrumentQueries is true
+type QueryMetrics struct {
+	Duration *prometheus.HistogramVec // The duration of the queries by operation and status, ok or error, nil if Config.DisableHistogram is true.
+	Latency  *prometheus.SummaryVec   // The quantiles of the duration of the queries by operation, nil unless Config.SummaryObjectives is set.
+	Total    *prometheus.CounterVec   // The total number of queries by operation.
+	Errors   *prometheus.CounterVec   // The total number of failed queries by operation and class, see Config.ErrorClass, not found records are not counted.
+	Slow     *prometheus.CounterVec   // The total number of queries slower than Config.SlowQueryThreshold by operation, nil if not configured.
+
+	Deadlocks *prometheus.CounterVec // The total number of queries failing with a MySQL or Postgres deadlock by operation.
+
+	InFlight     *prometheus.GaugeVec     // The number of queries currently executing by operation.
+	RowsAffected *prometheus.CounterVec   // The total number of rows affected by create, update and delete operations.
+	RowsReturned *prometheus.HistogramVec // The number of rows returned by the query operations, nil unless Config.RowsBuckets is set.
+	Transactions *prometheus.CounterVec   // The total number of transactions begun, committed and rolled back, by Begin, Transaction or gorm around writes.
+}
+
+func newQueryMetrics(labels map[string]string, config *Config) *QueryMetrics {
+	labelNames := queryLabelNames(config)
+	metrics := &QueryMetrics{
+		Total: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_queries_total",
+			Help:        "The total number of queries by operation.",
+			ConstLabels: labels,
+		}, labelNames),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_query_errors_total",
+			Help:        "The total number of failed queries by operation and class.",
+			ConstLabels: labels,
+		}, append(labelNames[:len(labelNames):len(labelNames)], "class")),
+		Deadlocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_query_deadlocks_total",
+			Help:        "The total number of queries failing with a deadlock by operation.",
+			ConstLabels: labels,
+		}, labelNames),
+		InFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_queries_in_flight",
+			Help:        "The number of queries currently executing by operation.",
+			ConstLabels: labels,
+		}, []string{"operation"}),
+		RowsAffected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_rows_affected_total",
+			Help:        "The total number of rows affected by create, update and delete operations.",
+			ConstLabels: labels,
+		}, labelNames),
+		Transactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_transactions_total",
+			Help:        "The total number of transactions by outcome (begin, commit, rollback).",
+			ConstLabels: labels,
+		}, []string{"outcome"}),
+	}
+
+	if !config.DisableHistogram {
+		metrics.Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_query_duration_seconds",
+			Help:        "The duration of the queries by operation and status.",
+			ConstLabels: labels,
+			Buckets:     config.HistogramBuckets,
+
+			NativeHistogramBucketFactor:    config.NativeHistogramBucketFactor,
+			NativeHistogramMaxBucketNumber: config.NativeHistogramMaxBuckets,
+		}, append(labelNames[:len(labelNames):len(labelNames)], "status"))
+	}
+
+	if len(config.SummaryObjectives) > 0 {
+		metrics.Latency = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_query_latency_seconds",
+			Help:        "The quantiles of the duration of the queries by operation.",
+			ConstLabels: labels,
+			Objectives:  config.SummaryObjectives,
+			MaxAge:      config.SummaryMaxAge,
+		}, labelNames)
+	}
+
+	if len(config.RowsBuckets) > 0 {
+		metrics.RowsReturned = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_query_rows_returned",
+			Help:        "The number of rows returned by the query operations.",
+			ConstLabels: labels,
+			Buckets:     config.RowsBuckets,
+		}, labelNames)
+	}
+
+	if config.SlowQueryThreshold > 0 {
+		metrics.Slow = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_slow_queries_total",
+			Help:        "The total number of queries slower than the threshold by operation.",
+			ConstLabels: labels,
+		}, labelNames)
+	}
+
+	return metrics
+}
+
+// register registers the collectors in metrics, replacing them with the already registered ones if returned by register,
+// it returns the errors of the ones failing to register
+func (metrics *QueryMetrics) register(register func(prometheus.Collector) (prometheus.Collector, error)) error {
+	return registerFields(metrics, register)
+}
+
+// Collectors returns the collectors in metrics
+func (metrics *QueryMetrics) Collectors() []prometheus.Collector {
+	return fieldCollectors(metrics)
+}
+
+// registerCallbacks registers the callbacks recording QueryMetrics around each operation of db
+func (p *Prometheus) registerCallbacks(db *gorm.DB) {
+	callback := db.Callback()
+	operations := []struct {
+		name          string
+		get           func(name string) func(*gorm.DB)
+		before, after func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", callback.Create().Get, callback.Create().Before("*").Register, callback.Create().After("*").Register},
+		{"query", callback.Query().Get, callback.Query().Before("*").Register, callback.Query().After("*").Register},
+		{"update", callback.Update().Get, callback.Update().Before("*").Register, callback.Update().After("*").Register},
+		{"delete", callback.Delete().Get, callback.Delete().Before("*").Register, callback.Delete().After("*").Register},
+		{"row", callback.Row().Get, callback.Row().Before("*").Register, callback.Row().After("*").Register},
+		{"raw", callback.Raw().Get, callback.Raw().Before("*").Register, callback.Raw().After("*").Register},
+	}
+
+	for _, operation := range operations {
+		if !p.instrumented(operation.name) {
+			continue
+		}
+
+		beforeName, afterName := callbackPrefix+"before_"+operation.name, callbackPrefix+"after_"+operation.name
+		if operation.get(beforeName) != nil { // already registered by a previous Initialize
+			continue
+		}
+
+		if err := operation.before(beforeName, p.before(operation.name)); err != nil {
+			p.logError("gorm:prometheus register callback err: %v", err)
+		}
+
+		if err := operation.after(afterName, p.after(operation.name)); err != nil {
+			p.logError("gorm:prometheus register callback err: %v", err)
+		}
+	}
+}
+
+func (p *Prometheus) before(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		metrics := p.queryMetrics()
+		if metrics == nil {
+			return
+		}
+
+		inFlight := metrics.InFlight.WithLabelValues(operation)
+		inFlight.Inc()
+		db.InstanceSet(inFlightInstance, inFlight)
+		db.InstanceSet(startTimeInstance, p.now())
+	}
+}
+
+func (p *Prometheus) after(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(startTimeInstance)
+		if !ok {
+			return
+		}
+
+		if inFlight, ok := db.InstanceGet(inFlightInstance); ok {
+			inFlight.(prometheus.Gauge).Dec()
+		}
+
+		metrics := p.queryMetrics()
+		startTime, ok := value.(time.Time)
+		if !ok || metrics == nil {
+			return
+		}
+
+		elapsed := p.now().Sub(startTime)
+		labelValues := p.queryLabelValues(db, operation)
+		status := "ok"
+		if isQueryError(db.Error) {
+			status = "error"
+		}
+
+		if metrics.Duration != nil {
+			p.observe(db.Statement.Context, metrics.Duration.WithLabelValues(append(labelValues[:len(labelValues):len(labelValues)], status)...), elapsed.Seconds())
+		}
+
+		if metrics.Latency != nil {
+			metrics.Latency.WithLabelValues(labelValues...).Observe(elapsed.Seconds())
+		}
+		metrics.Total.WithLabelValues(labelValues...).Inc()
+
+		if metrics.Slow != nil && elapsed >= p.Config.SlowQueryThreshold {
+			metrics.Slow.WithLabelValues(labelValues...).Inc()
+		}
+
+		if isQueryError(db.Error) {
+			metrics.Errors.WithLabelValues(append(labelValues[:len(labelValues):len(labelValues)], p.errorClass(db.Error))...).Inc()
+
+			if isDeadlock(db.Error) {
+				metrics.Deadlocks.WithLabelValues(labelValues...).Inc()
+			}
+		}
+
+		if writeOperations[operation] && db.RowsAffected > 0 {
+			metrics.RowsAffected.WithLabelValues(labelValues...).Add(float64(db.RowsAffected))
+		}
+
+		if operation == "query" && metrics.RowsReturned != nil && !isQueryError(db.Error) {
+			metrics.RowsReturned.WithLabelValues(labelValues...).Observe(float64(db.RowsAffected)) // the number of rows scanned
+		}
+	}
+}
+
+// observe observes value, with the trace id of ctx as an exemplar if Config.TraceID returns one and the metrics are exposed as OpenMetrics
+func (p *Prometheus) observe(ctx context.Context, observer prometheus.Observer, value float64) {
+	if p.Config.TraceID != nil && p.Config.openMetrics() {
+		exemplarObserver, ok := observer.(prometheus.ExemplarObserver)
+		if traceID := p.Config.TraceID(ctx); ok && validExemplar(traceID) {
+			exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{traceIDLabel: traceID})
+			return
+		}
+	}
+	observer.Observe(value)
+}
+
+// validExemplar reports whether traceID is a valid exemplar label value, ObserveWithExemplar panics otherwise
+func validExemplar(traceID string) bool {
+	return traceID != "" && utf8.ValidString(traceID) && utf8.RuneCountInString(traceIDLabel+traceID) <= prometheus.ExemplarMaxRunes
+}
+
+// instrumented reports whether the operation is listed in Config.Operations, or it is empty
+func (p *Prometheus) instrumented(operation string) bool {
+	if len(p.Config.Operations) == 0 {
+		return true
+	}
+
+	for _, name := range p.Config.Operations {
+		if name == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOperations returns an error if one of names isn't an operation
+func validateOperations(names []string) error {
+	for _, name := range names {
+		found := false
+		for _, operation := range operationNames {
+			if name == operation {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("gorm:prometheus unknown operation %q", name)
+		}
+	}
+	return nil
+}
+
+// queryLabelNames returns the variable labels of the query metrics
+func queryLabelNames(config *Config) []string {
+	names := []string{"operation"}
+	if config.TableLabel {
+		names = append(names, "table")
+	}
+
+	if config.SQLLabel != nil {
+		names = append(names, "sql")
+	}
+
+	if config.ContextLabels != nil {
+		names = append(names, config.ContextLabelNames...)
+	}
+	return names
+}
+
+// queryLabelValues returns the values of the labels returned by queryLabelNames for the statement of db
+func (p *Prometheus) queryLabelValues(db *gorm.DB, operation string) []string {
+	values := []string{operation}
+	if p.Config.TableLabel {
+		values = append(values, p.tableLabel(db.Statement))
+	}
+
+	if p.Config.SQLLabel != nil {
+		values = append(values, p.sqlLabel(db.Statement))
+	}
+
+	if p.Config.ContextLabels != nil {
+		labels := p.Config.ContextLabels(db.Statement.Context)
+		for _, name := range p.Config.ContextLabelNames {
+			values = append(values, validOrOther(labels[name]))
+		}
+	}
+	return values
+}
+
+// tableLabel returns the table of stmt, or otherLabel if it is not allowed by Config.TableAllowlist or Config.MaxTableLabels
+func (p *Prometheus) tableLabel(stmt *gorm.Statement) string {
+	table := stmt.Table
+	if table == "" && stmt.Schema != nil {
+		table = stmt.Schema.Table
+	}
+
+	if len(p.Config.TableAllowlist) > 0 {
+		allowed := false
+		for _, name := range p.Config.TableAllowlist {
+			if name == table {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return otherLabel
+		}
+	}
+
+	if p.Config.MaxTableLabels > 0 {
+		p.tablesMu.Lock()
+		defer p.tablesMu.Unlock()
+		return limitLabel(&p.tables, p.Config.MaxTableLabels, table)
+	}
+
+	return table
+}
+
+// sqlLabel returns Config.SQLLabel of the sql of stmt, or otherLabel if it is not allowed by Config.MaxSQLLabels
+func (p *Prometheus) sqlLabel(stmt *gorm.Statement) string {
+	value := validOrOther(p.Config.SQLLabel(stmt.SQL.String()))
+
+	p.sqlsMu.Lock()
+	defer p.sqlsMu.Unlock()
+	return limitLabel(&p.sqls, p.Config.MaxSQLLabels, value)
+}
+
+// validOrOther returns value if it is a valid label value, otherLabel otherwise, WithLabelValues panics on invalid utf-8
+func validOrOther(value string) string {
+	if validLabelValue(value) {
+		return value
+	}
+	return otherLabel
+}
+
+// limitLabel returns value if it is one of the first max values added to seen, otherLabel otherwise
+func limitLabel(seen *map[string]bool, max int, value string) string {
+	if !(*seen)[value] {
+		if len(*seen) >= max {
+			return otherLabel
+		}
+
+		if *seen == nil {
+			*seen = map[string]bool{}
+		}
+		(*seen)[value] = true
+	}
+	return value
+}
+
+// isQueryError reports whether err is a failure, not found records are not
+func isQueryError(err error) bool {
+	return err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, sql.ErrNoRows)
+}
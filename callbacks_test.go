@@ -0,0 +1,163 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gorm.io/gorm"
+)
+
+type testUser struct {
+	ID   uint
+	Name string
+}
+
+func TestTransactions(t *testing.T) {
+	p := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), InstrumentQueries: true})
+	db := openTestDB(t)
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	check := func(when string, begun, committed, rolledBack float64) {
+		t.Helper()
+		for outcome, expected := range map[string]float64{"begin": begun, "commit": committed, "rollback": rolledBack} {
+			if n := testutil.ToFloat64(p.QueryMetrics.Transactions.WithLabelValues(outcome)); n != expected {
+				t.Errorf("%s: %v transactions counted as %s, expected %v", when, n, outcome, expected)
+			}
+		}
+	}
+
+	db.Create(&testUser{Name: "a"})
+	db.Model(&testUser{ID: 1}).Update("name", "b")
+	check("the default transactions", 2, 2, 0)
+
+	db.Session(&gorm.Session{SkipDefaultTransaction: true}).Create(&testUser{Name: "c"})
+	check("SkipDefaultTransaction", 2, 2, 0)
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&testUser{Name: "d"}).Error // in the transaction, not a default one of its own
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check("Transaction", 3, 3, 0)
+
+	failed := errors.New("failed")
+	if err := db.Transaction(func(*gorm.DB) error { return failed }); !errors.Is(err, failed) {
+		t.Fatalf("Transaction returned %v", err)
+	}
+	check("a failed Transaction", 4, 3, 1)
+
+	if err := db.Begin().Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	if err := tx.Rollback().Error; err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback() // already rolled back
+	check("Begin", 6, 4, 2)
+
+	if _, err := db.DB(); err != nil {
+		t.Errorf("DB() with the transactions instrumented: %v", err)
+	}
+
+	p.Stop()
+	if err := p.Initialize(db); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Create(&testUser{Name: "e"})
+	if begun := testutil.ToFloat64(p.QueryMetrics.Transactions.WithLabelValues("begin")); begun != 1 {
+		t.Errorf("%v transactions begun after Stop and Initialize, expected 1 of the new metrics", begun)
+	}
+}
+
+func TestInvalidLabelValues(t *testing.T) {
+	p := New(Config{
+		DBName:            "db1",
+		Registerer:        prometheus.NewRegistry(),
+		InstrumentQueries: true,
+		ContextLabels: func(context.Context) map[string]string {
+			return map[string]string{"tenant": "\xff"}
+		},
+		ContextLabelNames: []string{"tenant"},
+		SQLLabel: func(string) string {
+			return "\xfe"
+		},
+		ErrorClass: func(error) string {
+			return "\xfd"
+		},
+	})
+	db := openTestDB(t)
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	db.Find(&[]testUser{})
+	if total := testutil.ToFloat64(p.QueryMetrics.Total.WithLabelValues("query", otherLabel, otherLabel)); total != 1 {
+		t.Errorf("%v queries labeled %s, expected 1", total, otherLabel)
+	}
+
+	if err := db.Callback().Query().Before("gorm:query").Register("test:fail", func(db *gorm.DB) {
+		db.AddError(errors.New("failed"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Find(&[]testUser{})
+	if failed := testutil.ToFloat64(p.QueryMetrics.Errors.WithLabelValues("query", otherLabel, otherLabel, otherLabel)); failed != 1 {
+		t.Errorf("%v query errors of class %s, expected 1", failed, otherLabel)
+	}
+}
+
+func TestInFlightAcrossSetLabel(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p := New(Config{DBName: "db1", Registerer: registry, InstrumentQueries: true, ConstLabels: map[string]string{"color": "blue"}})
+	db := openTestDB(t)
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	var queries int32
+	if err := db.Callback().Query().Register("test:set_label", func(*gorm.DB) { // between the callbacks of the plugin, so that every query straddles a SetLabel
+		color := "blue"
+		if atomic.AddInt32(&queries, 1)%2 == 0 {
+			color = "green"
+		}
+
+		if err := p.SetLabel("color", color); err != nil {
+			t.Error(err)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				var users []testUser
+				db.Find(&users)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, metric := range gather(t, registry)["gorm_queries_in_flight"].GetMetric() {
+		if value := metric.GetGauge().GetValue(); value != 0 {
+			t.Errorf("%v queries in flight after they all finished", value)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package prometheus
+
+import "time"
+
+// clock is the source of time of the plugin, replaceable to drive the refresh and push loops without waiting
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// ticker is the part of time.Ticker used by the plugin
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// now returns the current time of the plugin clock
+func (p *Prometheus) now() time.Time {
+	return p.clock.Now()
+}
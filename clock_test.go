@@ -0,0 +1,289 @@
+package prometheus
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClock is a clock whose time only passes by Advance
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTicker{clock: c, interval: d, next: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	return timer.c
+}
+
+// Advance moves the time forward by d, firing the tickers and the timers due, a ticker drops the ticks not received like time.Ticker
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.interval)
+		}
+	}
+
+	timers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			timers = append(timers, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = timers
+}
+
+// waiting returns the number of running tickers and pending timers
+func (c *fakeClock) waiting() (tickers, timers int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tickers), len(c.timers)
+}
+
+// nextTimer returns the time left until the earliest pending timer fires, false if there is none
+func (c *fakeClock) nextTimer() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.timers) == 0 {
+		return 0, false
+	}
+
+	next := c.timers[0].at
+	for _, timer := range c.timers[1:] {
+		if timer.at.Before(next) {
+			next = timer.at
+		}
+	}
+	return next.Sub(c.now), true
+}
+
+type fakeTicker struct {
+	clock    *fakeClock
+	interval time.Duration
+	next     time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			break
+		}
+	}
+}
+
+func TestRefreshLoopFollowsTheClock(t *testing.T) {
+	clock := newFakeClock()
+	p := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), RefreshDuration: time.Minute})
+	p.clock = clock
+
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	var refreshes int32
+	db := openTestDB(t)
+	if err := p.addDatabase("counted", "", func() (*sql.DB, error) {
+		atomic.AddInt32(&refreshes, 1)
+		return db.DB()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the refresh ticker", func() bool {
+		tickers, _ := clock.waiting()
+		return tickers == 1
+	})
+
+	clock.Advance(30 * time.Second)
+	time.Sleep(10 * time.Millisecond) // a refresh before the interval would have happened by now
+	if n := atomic.LoadInt32(&refreshes); n != 0 {
+		t.Fatalf("%d refreshes before the interval elapsed", n)
+	}
+
+	for i := int32(1); i <= 3; i++ {
+		clock.Advance(time.Minute)
+		waitFor(t, "the refresh of the tick", func() bool {
+			return atomic.LoadInt32(&refreshes) == i
+		})
+	}
+
+	p.Stop()
+	if tickers, _ := clock.waiting(); tickers != 0 {
+		t.Errorf("%d tickers still running after Stop", tickers)
+	}
+}
+
+func TestPushLoopFollowsTheClock(t *testing.T) {
+	var pushes int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.AddInt32(&pushes, 1) == 2 { // the first periodic push fails once
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	clock := newFakeClock()
+	p := New(Config{
+		DBName:           "db1",
+		Registerer:       prometheus.NewRegistry(),
+		RefreshDuration:  time.Hour,
+		PushAddr:         gateway.URL,
+		PushInterval:     60,
+		PushRetries:      1,
+		PushRetryBackoff: 10 * time.Second,
+	})
+	p.clock = clock
+
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	waitFor(t, "the push on Initialize", func() bool {
+		return atomic.LoadInt32(&pushes) == 1
+	})
+
+	waitFor(t, "the refresh and push tickers", func() bool {
+		tickers, _ := clock.waiting()
+		return tickers == 2
+	})
+
+	clock.Advance(time.Minute)
+	waitFor(t, "the retry backoff", func() bool {
+		_, timers := clock.waiting()
+		return timers == 1
+	})
+
+	if n := atomic.LoadInt32(&pushes); n != 2 {
+		t.Fatalf("%d pushes before the retry backoff elapsed, expected 2", n)
+	}
+
+	clock.Advance(10 * time.Second) // the backoff is at most PushRetryBackoff with its jitter
+	waitFor(t, "the retry", func() bool {
+		return atomic.LoadInt32(&pushes) == 3
+	})
+}
+
+func TestPushRetryBackoff(t *testing.T) {
+	var pushes int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&pushes, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer gateway.Close()
+
+	clock := newFakeClock()
+	p := New(Config{
+		DBName:           "db1",
+		Registerer:       prometheus.NewRegistry(),
+		RefreshDuration:  time.Hour,
+		PushAddr:         gateway.URL,
+		PushRetries:      3,
+		PushRetryBackoff: 20 * time.Second,
+	})
+	p.clock = clock
+
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	for retry, backoff := range []time.Duration{20 * time.Second, 40 * time.Second, maxPushRetryBackoff} { // doubled up to the max
+		var delay time.Duration
+		waitFor(t, "the retry backoff", func() bool {
+			var ok bool
+			delay, ok = clock.nextTimer()
+			return ok
+		})
+
+		if delay < backoff/2 || delay > backoff {
+			t.Errorf("retry %d in %s, expected a backoff between %s and %s", retry+1, delay, backoff/2, backoff)
+		}
+
+		if n := atomic.LoadInt32(&pushes); n != int32(retry+1) {
+			t.Errorf("%d pushes before retry %d, expected %d", n, retry+1, retry+1)
+		}
+
+		if failures := testutil.ToFloat64(p.pluginMetrics().PushErrors); failures != 0 {
+			t.Errorf("%v push errors counted before the retries ran out", failures)
+		}
+		clock.Advance(delay)
+	}
+
+	waitFor(t, "the push error once the retries ran out", func() bool {
+		return testutil.ToFloat64(p.pluginMetrics().PushErrors) == 1
+	})
+
+	if n := atomic.LoadInt32(&pushes); n != 4 {
+		t.Errorf("%d pushes, expected the push and 3 retries", n)
+	}
+
+	if _, ok := clock.nextTimer(); ok {
+		t.Error("a retry is pending once the retries ran out")
+	}
+}
@@ -0,0 +1,136 @@
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// addedCollector is a collector of AddCollector with the one registered in its place, the existing one if it was already registered
+type addedCollector struct {
+	collector  prometheus.Collector
+	registered prometheus.Collector
+}
+
+// AddCollector registers collector with the plugin's registry and pushes it along with the plugin's metrics,
+// e.g. for metrics available after the plugin is initialized, Stop unregisters it and Initialize registers it again
+func (p *Prometheus) AddCollector(collector prometheus.Collector) error {
+	registered, err := p.register(collector)
+	if err != nil {
+		return err
+	}
+
+	p.addedMu.Lock()
+	defer p.addedMu.Unlock()
+
+	for _, added := range p.added {
+		if added.collector == collector {
+			return nil
+		}
+	}
+	p.added = append(p.added, addedCollector{collector: collector, registered: registered})
+	return nil
+}
+
+// RemoveCollector unregisters collector, or the already registered collector AddCollector pushes in its place, from the plugin's registry
+// and stops pushing it, it returns false if collector wasn't added, it is safe to call for any collector
+func (p *Prometheus) RemoveCollector(collector prometheus.Collector) bool {
+	p.addedMu.Lock()
+	var registered prometheus.Collector
+	for _, added := range p.added {
+		if added.collector == collector || added.registered == collector {
+			registered = added.registered
+			break
+		}
+	}
+
+	if registered == nil {
+		p.addedMu.Unlock()
+		return false
+	}
+
+	added := p.added[:0] // the collectors added in place of the same registered one are removed with it, they are the same metrics
+	for _, a := range p.added {
+		if a.registered != registered {
+			added = append(added, a)
+		}
+	}
+	p.added = added
+	p.addedMu.Unlock()
+
+	return p.unregister(registered)
+}
+
+// registerAdded registers the collectors of AddCollector again after the plugin was stopped
+func (p *Prometheus) registerAdded() {
+	p.addedMu.Lock()
+	defer p.addedMu.Unlock()
+
+	for i, added := range p.added {
+		registered, err := p.register(added.registered)
+		if err != nil {
+			p.logError("gorm:prometheus failed to register collector, got error: %v", err)
+			continue
+		}
+		p.added[i].registered = registered
+	}
+}
+
+// addedCollectors returns the collectors registered in place of the ones of AddCollector
+func (p *Prometheus) addedCollectors() []prometheus.Collector {
+	p.addedMu.Lock()
+	defer p.addedMu.Unlock()
+
+	var collectors []prometheus.Collector
+	for _, added := range p.added {
+		found := false
+		for _, c := range collectors {
+			if c == added.registered {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			collectors = append(collectors, added.registered)
+		}
+	}
+	return collectors
+}
+
+// Collectors returns a copy of the collectors managed by the plugin and pushed to the pushgateway: its own, the ones of the added databases,
+// MetricsCollector and AddCollector, e.g. to check the wiring or to register them with another registry
+func (p *Prometheus) Collectors() []prometheus.Collector {
+	var collectors []prometheus.Collector
+	if pluginMetrics := p.pluginMetrics(); pluginMetrics != nil { // created by Initialize
+		collectors = append(collectors, pluginMetrics.Collectors()...)
+	}
+
+	if stats := p.dbStats(); stats != nil {
+		collectors = append(collectors, stats.Collectors()...)
+	}
+
+	if queryMetrics := p.queryMetrics(); queryMetrics != nil {
+		collectors = append(collectors, queryMetrics.Collectors()...)
+	}
+
+	if migrationMetrics := p.migrationMetrics(); migrationMetrics != nil {
+		collectors = append(collectors, migrationMetrics.Collectors()...)
+	}
+
+	p.databasesMu.Lock()
+	for _, database := range p.databases {
+		collectors = append(collectors, database.stats.Collectors()...)
+	}
+	p.databasesMu.Unlock()
+
+	p.resolverPoolsMu.Lock()
+	for _, pool := range p.resolverPools {
+		collectors = append(collectors, pool.stats.Collectors()...)
+	}
+	p.resolverPoolsMu.Unlock()
+
+	collectors = append(collectors, p.addedCollectors()...)
+
+	p.registeredMu.Lock()
+	defer p.registeredMu.Unlock()
+	return append(collectors, p.collectors...)
+}
@@ -0,0 +1,75 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAddAndRemoveCollector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p := New(Config{DBName: "db1", Registerer: registry})
+	db := openTestDB(t)
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	contains := func(collector prometheus.Collector) bool {
+		for _, c := range p.Collectors() {
+			if c == collector {
+				return true
+			}
+		}
+		return false
+	}
+
+	added := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_added"})
+	if err := p.AddCollector(added); err != nil {
+		t.Fatal(err)
+	}
+
+	if gather(t, registry)["test_added"] == nil || !contains(added) {
+		t.Fatal("the added collector isn't registered and pushed")
+	}
+
+	if !p.RemoveCollector(added) {
+		t.Fatal("RemoveCollector didn't find the added collector")
+	}
+
+	if gather(t, registry)["test_added"] != nil || contains(added) {
+		t.Fatal("the removed collector is still registered or pushed")
+	}
+
+	if p.RemoveCollector(added) {
+		t.Error("RemoveCollector removed the collector twice")
+	}
+
+	existing := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_existing"})
+	registry.MustRegister(existing)
+	same := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_existing"})
+	if err := p.AddCollector(same); err != nil {
+		t.Fatal(err)
+	}
+
+	if !contains(existing) || contains(same) {
+		t.Fatal("the already registered collector isn't pushed in place of the added one")
+	}
+
+	if !p.RemoveCollector(same) {
+		t.Fatal("RemoveCollector didn't find the collector added in place of the already registered one")
+	}
+
+	if gather(t, registry)["test_existing"] != nil || contains(existing) {
+		t.Fatal("the already registered collector is still registered or pushed")
+	}
+
+	p.Stop()
+	if err := p.Initialize(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if families := gather(t, registry); families["test_added"] != nil || families["test_existing"] != nil {
+		t.Error("Initialize registered a removed collector again")
+	}
+}
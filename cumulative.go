@@ -0,0 +1,41 @@
+package prometheus
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cumulative is a collector exporting the last value set as a counter, for the cumulative values of sql.DBStats,
+// so that rate() and increase() work on them and handle their resets when the db is reopened
+type Cumulative struct {
+	desc *prometheus.Desc
+	bits uint64 // math.Float64bits of the value, accessed atomically
+}
+
+func newCumulative(opts prometheus.Opts) *Cumulative {
+	return &Cumulative{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, nil, opts.ConstLabels),
+	}
+}
+
+// Set sets the value, it does nothing if c is nil, i.e. disabled by Config.EnabledStats
+func (c *Cumulative) Set(value float64) {
+	if c != nil {
+		atomic.StoreUint64(&c.bits, math.Float64bits(value))
+	}
+}
+
+// Value returns the last value set
+func (c *Cumulative) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+func (c *Cumulative) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *Cumulative) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, c.Value())
+}
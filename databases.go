@@ -0,0 +1,152 @@
+package prometheus
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// database is an additional database whose stats are refreshed along with the plugin's db
+type database struct {
+	name   string
+	db     func() (*sql.DB, error)
+	labels map[string]string // labels of the database on top of the plugin's Labels
+	stats  *DBStats
+}
+
+// AddDB monitors the connection pool of db along with the plugin's db, its metrics are labeled with db_name set to name,
+// and with the name of its dialector if DriverLabel is set.
+// It must be called after the plugin is initialized with DBName set, the metrics of all the databases are exposed by the same registry.
+func (p *Prometheus) AddDB(name string, db *gorm.DB) error {
+	var driver string
+	if db.Dialector != nil {
+		driver = db.Dialector.Name()
+	}
+	return p.addDatabase(name, driver, db.DB)
+}
+
+// WatchDB monitors the connection pool db opened without gorm along with the plugin's db, like AddDB,
+// its metrics are labeled with db_name set to name, and with the name of the dialector of the plugin's db if DriverLabel is set.
+func (p *Prometheus) WatchDB(name string, db *sql.DB) error {
+	if db == nil {
+		return fmt.Errorf("gorm:prometheus nil db %q", name)
+	}
+	return p.addDatabase(name, "", func() (*sql.DB, error) { return db, nil })
+}
+
+// addDatabase adds the database, labeled with the plugin's driver unless driver is set
+func (p *Prometheus) addDatabase(name, driver string, db func() (*sql.DB, error)) error {
+	if p.db() == nil {
+		return errors.New("gorm:prometheus the plugin must be initialized before adding a database")
+	}
+
+	if p.Config.DBName == "" { // a registry requires the same label names for a metric name, so the plugin's metrics need db_name too
+		return errors.New("gorm:prometheus DBName must be set to add a database")
+	}
+
+	if name == "" || name == p.Config.DBName || !validLabelValue(name) {
+		return fmt.Errorf("gorm:prometheus invalid database name %q", name)
+	}
+
+	p.databasesMu.Lock()
+	defer p.databasesMu.Unlock()
+
+	for _, database := range p.databases {
+		if database.name == name {
+			return fmt.Errorf("gorm:prometheus database %q already added", name)
+		}
+	}
+
+	database := &database{name: name, db: db, labels: map[string]string{"db_name": name}}
+	if p.Config.DriverLabel != "" && driver != "" {
+		database.labels[p.Config.DriverLabel] = driver
+	}
+
+	stats, err := p.newDatabaseStats(database)
+	if err != nil {
+		return err
+	}
+
+	database.stats = stats
+	p.databases = append(p.databases, database)
+	return nil
+}
+
+// newDatabaseStats creates and registers the stats of database
+func (p *Prometheus) newDatabaseStats(database *database) (*DBStats, error) {
+	return newStats(statsPrefix, p.databaseLabels(database), p.Config).register(p.register)
+}
+
+// databaseLabels returns the labels of the metrics of database
+func (p *Prometheus) databaseLabels(database *database) map[string]string {
+	labels := p.labels()
+	for k, v := range database.labels {
+		if _, ok := labels[k]; ok { // only the values differ from the labels of the plugin's metrics, a registry requires the same label names
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// Database is one of the databases monitored by the plugin, see Databases
+type Database struct {
+	Name   string            // Config.DBName for the plugin's db, the name passed to AddDB or WatchDB otherwise
+	Labels map[string]string // the labels of its metrics, e.g. db_name
+	DB     *sql.DB
+}
+
+// Databases returns the plugin's db and the added ones with the current labels of their metrics, e.g. to export their stats elsewhere,
+// the ones whose *sql.DB isn't available, e.g. a custom connection pool, are left out
+func (p *Prometheus) Databases() []Database {
+	var databases []Database
+	if gormDB := p.db(); gormDB != nil {
+		if db, err := gormDB.DB(); err == nil {
+			databases = append(databases, Database{Name: p.Config.DBName, Labels: p.labels(), DB: db})
+		}
+	}
+
+	p.databasesMu.Lock()
+	defer p.databasesMu.Unlock()
+
+	for _, database := range p.databases {
+		if db, err := database.db(); err == nil {
+			databases = append(databases, Database{Name: database.name, Labels: p.databaseLabels(database), DB: db})
+		}
+	}
+	return databases
+}
+
+// registerDatabases registers the stats of the added databases again after the plugin was stopped
+func (p *Prometheus) registerDatabases() {
+	p.databasesMu.Lock()
+	defer p.databasesMu.Unlock()
+
+	for _, database := range p.databases {
+		stats, err := database.stats.register(p.register)
+		if err != nil {
+			p.logError("gorm:prometheus failed to register the db stats of %s, got error: %v", database.name, err)
+		}
+		database.stats = stats
+	}
+}
+
+// refreshDatabases refreshes the stats of the added databases, it returns the errors of the ones failing
+func (p *Prometheus) refreshDatabases() (errs error) {
+	p.databasesMu.Lock()
+	defer p.databasesMu.Unlock()
+
+	for _, database := range p.databases {
+		key := "refresh of " + database.name
+		if db, err := database.db(); err == nil {
+			p.setStats(database.stats, db)
+			p.recovered(key)
+		} else {
+			database.stats.refreshFailed()
+			p.logFailure(key, "gorm:prometheus failed to collect db status of %s, got error: %v", database.name, err)
+			errs = errors.Join(errs, fmt.Errorf("gorm:prometheus failed to collect db status of %s: %w", database.name, err))
+		}
+	}
+	return errs
+}
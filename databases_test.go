@@ -0,0 +1,146 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labelValues returns the values of the label name of the metrics of the family name gathered from registry
+func labelValues(t *testing.T, registry *prometheus.Registry, family, name string) []string {
+	t.Helper()
+
+	var values []string
+	if f := gather(t, registry)[family]; f != nil {
+		for _, metric := range f.Metric {
+			for _, label := range metric.Label {
+				if label.GetName() == name {
+					values = append(values, label.GetValue())
+				}
+			}
+		}
+	}
+	return values
+}
+
+func TestAddDB(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p := New(Config{DBName: "primary", DriverLabel: "driver", Registerer: registry})
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := p.AddDB("analytics", openTestDB(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.AddDB("analytics", openTestDB(t)); err == nil {
+		t.Error("adding a database twice succeeded")
+	}
+
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := labelValues(t, registry, "gorm_dbstats_open_connections", "db_name"); len(names) != 2 {
+		t.Errorf("db_name of the db stats %v, expected primary and analytics", names)
+	}
+
+	pushed := prometheus.NewRegistry() // the collectors are registered with a new registry for each push
+	for _, collector := range p.Collectors() {
+		if err := pushed.Register(collector); err != nil {
+			t.Fatalf("collectors can't be pushed: %v", err)
+		}
+	}
+	gather(t, pushed)
+}
+
+func TestAddDBRequiresDBName(t *testing.T) {
+	p := New(Config{Registerer: prometheus.NewRegistry()})
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := p.AddDB("analytics", openTestDB(t)); err == nil {
+		t.Error("adding a database without DBName succeeded, its db stats can't be registered along with the plugin's ones without db_name")
+	}
+}
+
+func TestDatabases(t *testing.T) {
+	p := New(Config{DBName: "primary", ConstLabels: map[string]string{"color": "blue"}, Registerer: prometheus.NewRegistry()})
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := p.AddDB("analytics", openTestDB(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SetLabel("color", "green"); err != nil {
+		t.Fatal(err)
+	}
+
+	databases := p.Databases()
+	if len(databases) != 2 {
+		t.Fatalf("%d databases, expected 2", len(databases))
+	}
+
+	for i, name := range []string{"primary", "analytics"} {
+		if database := databases[i]; database.Name != name || database.Labels["db_name"] != name || database.Labels["color"] != "green" || database.DB == nil {
+			t.Errorf("database %d is %s with labels %v, expected %s labeled color=green", i, database.Name, database.Labels, name)
+		}
+	}
+}
+
+func TestWatchDB(t *testing.T) {
+	unnamed := New(Config{Registerer: prometheus.NewRegistry()})
+	if err := openTestDB(t).Use(unnamed); err != nil {
+		t.Fatal(err)
+	}
+	defer unnamed.Stop()
+
+	jobs, err := openTestDB(t).DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unnamed.WatchDB("jobs", jobs); err == nil {
+		t.Error("watching a database without DBName succeeded")
+	}
+
+	registry := prometheus.NewRegistry()
+	p := New(Config{DBName: "primary", DriverLabel: "driver", ConstLabels: map[string]string{"region": "eu"}, Registerer: registry})
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	for _, name := range []string{"", "primary"} {
+		if err := p.WatchDB(name, jobs); err == nil {
+			t.Errorf("watching a database named %q succeeded", name)
+		}
+	}
+
+	if err := p.WatchDB("nil", nil); err == nil {
+		t.Error("watching a nil database succeeded")
+	}
+
+	if err := p.WatchDB("jobs", jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	family := "gorm_dbstats_open_connections"
+	for name, expected := range map[string][]string{"db_name": {"jobs", "primary"}, "driver": {"test", "test"}, "region": {"eu", "eu"}} {
+		values := labelValues(t, registry, family, name)
+		if len(values) != len(expected) || values[0] != expected[0] || values[1] != expected[1] { // gathered sorted by label values
+			t.Errorf("%s of the db stats %v, expected %v", name, values, expected)
+		}
+	}
+}
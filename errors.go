@@ -0,0 +1,100 @@
+package prometheus
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"reflect"
+)
+
+const (
+	mysqlDeadlock    = 1213    // ER_LOCK_DEADLOCK
+	postgresDeadlock = "40P01" // deadlock_detected
+)
+
+// the classes of the query errors returned by ClassifyError
+const (
+	ConnectionError = "connection"
+	TimeoutError    = "timeout"
+	CanceledError   = "canceled"
+	QueryError      = "query"
+)
+
+// ClassifyError is the default Config.ErrorClass, it tells the errors of the connection to the database apart from the errors of the queries,
+// e.g. constraint violations, so that alerts can only fire on connectivity problems
+func ClassifyError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return TimeoutError
+	case errors.Is(err, context.Canceled):
+		return CanceledError
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.As(err, &netErr):
+		if netErr != nil && netErr.Timeout() {
+			return TimeoutError
+		}
+		return ConnectionError
+	default:
+		return QueryError
+	}
+}
+
+// errorClass returns the class label of err, otherLabel if Config.ErrorClass returns an invalid label value
+func (p *Prometheus) errorClass(err error) string {
+	if p.Config.ErrorClass != nil {
+		return validOrOther(p.Config.ErrorClass(err))
+	}
+	return ClassifyError(err)
+}
+
+// isDeadlock reports whether err is a deadlock error of MySQL or Postgres, without depending on their drivers:
+// the Number field of github.com/go-sql-driver/mysql.MySQLError, the SQLState method of github.com/jackc/pgconn.PgError
+// or the Code field of github.com/lib/pq.Error, err or one of the errors it wraps, e.g. by errors.Join
+func isDeadlock(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if isDriverDeadlock(err) {
+		return true
+	}
+
+	switch wrapper := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, err := range wrapper.Unwrap() {
+			if isDeadlock(err) {
+				return true
+			}
+		}
+	case interface{ Unwrap() error }:
+		return isDeadlock(wrapper.Unwrap())
+	}
+	return false
+}
+
+// isDriverDeadlock reports whether err itself is a deadlock error of one of the drivers of isDeadlock
+func isDriverDeadlock(err error) bool {
+	if state, ok := err.(interface{ SQLState() string }); ok && state.SQLState() == postgresDeadlock {
+		return true
+	}
+
+	value := reflect.ValueOf(err)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return false
+	}
+
+	if number := value.FieldByName("Number"); number.IsValid() && number.Kind() == reflect.Uint16 && number.Uint() == mysqlDeadlock {
+		return true
+	}
+
+	if code := value.FieldByName("Code"); code.IsValid() && code.Kind() == reflect.String && code.String() == postgresDeadlock {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package prometheus
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// netError is a net.Error, timing out or not
+type netError struct {
+	timeout bool
+}
+
+func (e netError) Error() string {
+	return "i/o timeout"
+}
+
+func (e netError) Timeout() bool {
+	return e.timeout
+}
+
+func (e netError) Temporary() bool {
+	return false
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"deadline", context.DeadlineExceeded, TimeoutError},
+		{"wrapped deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), TimeoutError},
+		{"canceled", context.Canceled, CanceledError},
+		{"bad connection", driver.ErrBadConn, ConnectionError},
+		{"wrapped bad connection", fmt.Errorf("query: %w", driver.ErrBadConn), ConnectionError},
+		{"network timeout", netError{timeout: true}, TimeoutError},
+		{"network error", netError{timeout: false}, ConnectionError},
+		{"plain error", errors.New("duplicate key"), QueryError},
+	} {
+		if class := ClassifyError(c.err); class != c.expected {
+			t.Errorf("%s: class %s, expected %s", c.name, class, c.expected)
+		}
+	}
+}
+
+// mysqlError is shaped like github.com/go-sql-driver/mysql.MySQLError
+type mysqlError struct {
+	Number  uint16
+	Message string
+}
+
+func (e *mysqlError) Error() string {
+	return e.Message
+}
+
+// pgError is shaped like github.com/jackc/pgconn.PgError
+type pgError struct {
+	Code string
+}
+
+func (e *pgError) Error() string {
+	return "pg error " + e.Code
+}
+
+func (e *pgError) SQLState() string {
+	return e.Code
+}
+
+// pqErrorCode and pqError are shaped like github.com/lib/pq.ErrorCode and Error
+type pqErrorCode string
+
+type pqError struct {
+	Code pqErrorCode
+}
+
+func (e pqError) Error() string {
+	return "pq error " + string(e.Code)
+}
+
+func TestIsDeadlock(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"mysql deadlock", &mysqlError{Number: 1213, Message: "Deadlock found"}, true},
+		{"mysql lock wait timeout", &mysqlError{Number: 1205, Message: "Lock wait timeout exceeded"}, false},
+		{"wrapped mysql deadlock", fmt.Errorf("update: %w", &mysqlError{Number: 1213}), true},
+		{"pgconn deadlock", &pgError{Code: "40P01"}, true},
+		{"pgconn serialization failure", &pgError{Code: "40001"}, false},
+		{"wrapped pgconn deadlock", fmt.Errorf("update: %w", &pgError{Code: "40P01"}), true},
+		{"lib/pq deadlock", pqError{Code: "40P01"}, true},
+		{"lib/pq unique violation", pqError{Code: "23505"}, false},
+		{"wrapped lib/pq deadlock", fmt.Errorf("update: %w", pqError{Code: "40P01"}), true},
+		{"joined deadlock", errors.Join(errors.New("rollback failed"), &mysqlError{Number: 1213}), true},
+		{"wrapped joined deadlock", fmt.Errorf("update: %w", errors.Join(errors.New("rollback failed"), pqError{Code: "40P01"})), true},
+		{"joined errors", errors.Join(errors.New("a"), errors.New("b")), false},
+		{"nil mysql error", (*mysqlError)(nil), false},
+		{"plain error", errors.New("deadlock"), false},
+		{"nil", nil, false},
+	} {
+		if deadlock := isDeadlock(c.err); deadlock != c.expected {
+			t.Errorf("%s: deadlock %t, expected %t", c.name, deadlock, c.expected)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package prometheus
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	stringLiteral   = regexp.MustCompile(`'(?:[^']|'')*'`)
+	positionalParam = regexp.MustCompile(`\$\d+\b`) // the placeholders of Postgres, $1, $2...
+	numberLiteral   = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	placeholderList = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)(?:\s*,\s*\(\s*\?(?:\s*,\s*\?)*\s*\))*`)
+	whitespace      = regexp.MustCompile(`\s+`)
+)
+
+// Fingerprint normalizes sql for Config.SQLLabel, the literals and the $1 placeholders of Postgres are replaced by ? placeholders,
+// the lists of placeholders, e.g. of IN or of the rows of VALUES, are collapsed into (?) and the whitespace is collapsed
+func Fingerprint(sql string) string {
+	sql = stringLiteral.ReplaceAllString(sql, "?")
+	sql = positionalParam.ReplaceAllString(sql, "?")
+	sql = numberLiteral.ReplaceAllString(sql, "?")
+	sql = placeholderList.ReplaceAllString(sql, "(?)")
+	return strings.TrimSpace(whitespace.ReplaceAllString(sql, " "))
+}
@@ -0,0 +1,25 @@
+package prometheus
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	for _, c := range []struct {
+		name, sql, expected string
+	}{
+		{"string literal", "SELECT * FROM users WHERE name = 'bob'", "SELECT * FROM users WHERE name = ?"},
+		{"escaped quote", "SELECT * FROM users WHERE name = 'o''brien' AND role = 'admin'", "SELECT * FROM users WHERE name = ? AND role = ?"},
+		{"numbers", "SELECT * FROM users WHERE id = 42 AND score > 1.5 LIMIT 10", "SELECT * FROM users WHERE id = ? AND score > ? LIMIT ?"},
+		{"number next to identifiers", "SELECT col1, t2.name FROM table_3 t2 WHERE t2.id=7", "SELECT col1, t2.name FROM table_3 t2 WHERE t2.id=?"},
+		{"in list", "SELECT * FROM users WHERE id IN (?,?, ?)", "SELECT * FROM users WHERE id IN (?)"},
+		{"in list of literals", "SELECT * FROM users WHERE id IN (1, 2, 3)", "SELECT * FROM users WHERE id IN (?)"},
+		{"multi-row values", "INSERT INTO users (name,age) VALUES (?,?),(?,?), (?, ?)", "INSERT INTO users (name,age) VALUES (?)"},
+		{"multi-row values of literals", "INSERT INTO users (name,age) VALUES ('a',1),('b',2)", "INSERT INTO users (name,age) VALUES (?)"},
+		{"postgres placeholders", "SELECT * FROM users WHERE id = $1 AND name = $2", "SELECT * FROM users WHERE id = ? AND name = ?"},
+		{"postgres in list", `SELECT * FROM "users" WHERE "id" IN ($1,$2,$10)`, `SELECT * FROM "users" WHERE "id" IN (?)`},
+		{"whitespace", "SELECT *\n\tFROM users\n  WHERE id = ?  ", "SELECT * FROM users WHERE id = ?"},
+	} {
+		if fingerprint := Fingerprint(c.sql); fingerprint != c.expected {
+			t.Errorf("%s: %q, expected %q", c.name, fingerprint, c.expected)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package prometheus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// SetLabel changes the value of the label name of all the metrics of the plugin, e.g. a deployment color changing without a restart.
+// The label must already be one of Labels, e.g. from ConstLabels, since a registry requires the same label names for a metric name.
+// The const labels of a collector are fixed, so the metrics of the plugin are unregistered and registered again with the new labels,
+// their counters start again from zero. The collectors of MetricsCollector and AddCollector keep their labels.
+func (p *Prometheus) SetLabel(name, value string) error {
+	if p.db() == nil {
+		return errors.New("gorm:prometheus the plugin must be initialized before setting a label")
+	}
+
+	if !model.LabelName(name).IsValid() || !validLabelValue(value) {
+		return fmt.Errorf("gorm:prometheus invalid label %s=%q", name, value)
+	}
+
+	p.labelsMu.Lock()
+	if _, ok := p.Labels[name]; !ok {
+		p.labelsMu.Unlock()
+		return fmt.Errorf("gorm:prometheus unknown label %s, only the value of the existing labels can be changed", name)
+	}
+
+	if p.setLabels == nil {
+		p.setLabels = map[string]string{}
+	}
+	p.setLabels[name] = value
+
+	labels := make(map[string]string, len(p.Labels)+1)
+	for k, v := range p.Labels {
+		labels[k] = v
+	}
+	labels[name] = value
+	p.Labels = labels
+	p.labelsMu.Unlock()
+
+	p.unregisterAll(p.pluginMetrics().Collectors())
+	p.unregisterAll(p.dbStats().Collectors())
+	if queryMetrics := p.queryMetrics(); queryMetrics != nil {
+		p.unregisterAll(queryMetrics.Collectors())
+	}
+
+	if migrationMetrics := p.migrationMetrics(); migrationMetrics != nil {
+		p.unregisterAll(migrationMetrics.Collectors())
+	}
+	errs := p.newMetrics(p.labels())
+
+	p.databasesMu.Lock()
+	for _, database := range p.databases {
+		p.unregisterAll(database.stats.Collectors())
+
+		stats, err := p.newDatabaseStats(database)
+		database.stats = stats
+		errs = errors.Join(errs, err)
+	}
+	p.databasesMu.Unlock()
+
+	p.resolverPoolsMu.Lock()
+	for _, pool := range p.resolverPools {
+		p.unregisterAll(pool.stats.Collectors())
+	}
+	p.resolverPools = nil // created again with the new labels by the refresh
+	p.resolverPoolsMu.Unlock()
+
+	p.safely(p.refresh) // don't expose zero values until the next tick
+	return errs
+}
+
+// unregisterAll unregisters the collectors
+func (p *Prometheus) unregisterAll(collectors []prometheus.Collector) {
+	for _, collector := range collectors {
+		p.unregister(collector)
+	}
+}
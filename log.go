@@ -0,0 +1,74 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+)
+
+// logError logs an error of the plugin with Config.Logger, or the logger of the db if it isn't set
+func (p *Prometheus) logError(format string, args ...interface{}) {
+	if p.Config.Logger != nil {
+		p.Config.Logger.Error(fmt.Sprintf(format, args...))
+		return
+	}
+	p.db().Logger.Error(context.Background(), format, args...)
+}
+
+// logWarn logs a warning of the plugin with Config.Logger, or the logger of the db if it isn't set
+func (p *Prometheus) logWarn(format string, args ...interface{}) {
+	if p.Config.Logger != nil {
+		p.Config.Logger.Warn(fmt.Sprintf(format, args...))
+		return
+	}
+	p.db().Logger.Warn(context.Background(), format, args...)
+}
+
+// logInfo logs an information of the plugin with Config.Logger, or the logger of the db if it isn't set
+func (p *Prometheus) logInfo(format string, args ...interface{}) {
+	if p.Config.Logger != nil {
+		p.Config.Logger.Info(fmt.Sprintf(format, args...))
+		return
+	}
+	p.db().Logger.Info(context.Background(), format, args...)
+}
+
+// logFailure logs an error of the recurring operation key, e.g. the pushes to a pushgateway, at error level the first time
+// and at info level until the operation recovers, so that a pushgateway briefly down doesn't flood the logs, unless Config.LogRepeatedErrors is true
+func (p *Prometheus) logFailure(key string, format string, args ...interface{}) {
+	if p.setFailing(key, true) && !p.Config.LogRepeatedErrors {
+		p.logInfo(format, args...)
+		return
+	}
+	p.logError(format, args...)
+}
+
+// recovered records the success of the recurring operation key, logging it if it was failing
+func (p *Prometheus) recovered(key string) {
+	if p.setFailing(key, false) {
+		p.logInfo("gorm:prometheus %s recovered", key)
+	}
+}
+
+// isFailing reports whether the last run of the recurring operation key failed
+func (p *Prometheus) isFailing(key string) bool {
+	p.failuresMu.Lock()
+	defer p.failuresMu.Unlock()
+	return p.failures[key]
+}
+
+// setFailing records whether the last run of the recurring operation key failed, it returns whether the previous one did
+func (p *Prometheus) setFailing(key string, failing bool) bool {
+	p.failuresMu.Lock()
+	defer p.failuresMu.Unlock()
+
+	previous := p.failures[key]
+	if failing {
+		if p.failures == nil {
+			p.failures = map[string]bool{}
+		}
+		p.failures[key] = true
+	} else {
+		delete(p.failures, key)
+	}
+	return previous
+}
@@ -0,0 +1,112 @@
+package prometheus
+
+import (
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Version is the version of the plugin reported by gorm_prometheus_build_info,
+// set it with -ldflags "-X github.com/markus621/prometheus.Version=v1.2.3", otherwise it is read from the build info
+var Version string
+
+const modulePath = "github.com/markus621/prometheus"
+
+// PluginMetrics are the metrics of the plugin itself
+type PluginMetrics struct {
+	Panics    prometheus.Counter // The total number of panics recovered in the background goroutines.
+	BuildInfo prometheus.Gauge   // Always 1, labeled with the version of the plugin.
+
+	StatsUnsupported prometheus.Gauge     // 1 if the connection pool of the plugin's db doesn't provide db stats, e.g. a custom pool, 0 otherwise.
+	Registered       prometheus.GaugeFunc // The number of collectors registered by the plugin, its own and the ones of MetricsCollector and AddCollector.
+
+	PushErrors prometheus.Counter // The total number of failed pushes to any of the pushgateways, after their retries, only if PushAddr or PushAddrs is set.
+	LastPush   prometheus.Gauge   // The unix timestamp in seconds of the last successful push to any of the pushgateways, only if PushAddr or PushAddrs is set.
+}
+
+func newPluginMetrics(labels map[string]string, config *Config, collectors func() float64) *PluginMetrics {
+	buildInfoLabels := map[string]string{"version": version()}
+	for k, v := range labels {
+		buildInfoLabels[k] = v
+	}
+
+	metrics := &PluginMetrics{
+		Panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_prometheus_panics_total",
+			Help:        "The total number of panics recovered in the background goroutines.",
+			ConstLabels: labels,
+		}),
+		BuildInfo: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_prometheus_build_info",
+			Help:        "Always 1, labeled with the version of the plugin.",
+			ConstLabels: buildInfoLabels,
+		}),
+		StatsUnsupported: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_prometheus_stats_unsupported",
+			Help:        "1 if the connection pool of the db doesn't provide db stats, 0 otherwise.",
+			ConstLabels: labels,
+		}),
+		Registered: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_prometheus_collectors",
+			Help:        "The number of collectors registered by the plugin.",
+			ConstLabels: labels,
+		}, collectors),
+	}
+	metrics.BuildInfo.Set(1)
+
+	if len(config.pushAddrs()) > 0 {
+		metrics.PushErrors = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_prometheus_push_errors_total",
+			Help:        "The total number of failed pushes to the pushgateway, after their retries.",
+			ConstLabels: labels,
+		})
+		metrics.LastPush = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_prometheus_last_push_timestamp_seconds",
+			Help:        "The unix timestamp in seconds of the last successful push to the pushgateway.",
+			ConstLabels: labels,
+		})
+	}
+	return metrics
+}
+
+// version returns Version, or the version of the module in the build info, or unknown
+func version() string {
+	if Version != "" {
+		return Version
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" {
+			return info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// register registers the collectors in metrics, replacing them with the already registered ones if returned by register,
+// it returns the errors of the ones failing to register
+func (metrics *PluginMetrics) register(register func(prometheus.Collector) (prometheus.Collector, error)) error {
+	return registerFields(metrics, register)
+}
+
+// Collectors returns the collectors in metrics
+func (metrics *PluginMetrics) Collectors() []prometheus.Collector {
+	return fieldCollectors(metrics)
+}
@@ -0,0 +1,144 @@
+package prometheus
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+const migrationStartTimeInstance = "prometheus:migration_start_time"
+
+var migrationBuckets = []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300} // seconds, building an index on a large table takes minutes
+
+var unquoteTable = strings.NewReplacer("`", "", `"`, "", "[", "", "]", "", ";", "") // the quotes of the identifiers of a table name and the ending semicolon
+
+// MigrationMetrics are recorded by the callbacks registered if Config.InstrumentMigrations is true
+type MigrationMetrics struct {
+	MigrationDuration *prometheus.HistogramVec // The duration of the schema changes, e.g. by AutoMigrate, by operation, e.g. create_table or create_index, and table.
+}
+
+func newMigrationMetrics(labels map[string]string, config *Config) *MigrationMetrics {
+	return &MigrationMetrics{
+		MigrationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        "gorm_migration_duration_seconds",
+			Help:        "The duration of the schema changes by operation and table.",
+			ConstLabels: labels,
+			Buckets:     migrationBuckets,
+		}, []string{"operation", "table"}),
+	}
+}
+
+// register registers the collectors in metrics, replacing them with the already registered ones if returned by register,
+// it returns the errors of the ones failing to register
+func (metrics *MigrationMetrics) register(register func(prometheus.Collector) (prometheus.Collector, error)) error {
+	return registerFields(metrics, register)
+}
+
+// Collectors returns the collectors in metrics
+func (metrics *MigrationMetrics) Collectors() []prometheus.Collector {
+	return fieldCollectors(metrics)
+}
+
+// registerMigrationCallbacks registers the callbacks recording MigrationMetrics around the schema changes executed by db,
+// the migrator of gorm executes them as raw statements, so they are told apart by their sql
+func (p *Prometheus) registerMigrationCallbacks(db *gorm.DB) {
+	raw := db.Callback().Raw()
+	beforeName, afterName := callbackPrefix+"before_migration", callbackPrefix+"after_migration"
+	if raw.Get(beforeName) != nil { // already registered by a previous Initialize
+		return
+	}
+
+	if err := raw.Before("*").Register(beforeName, p.beforeMigration); err != nil {
+		p.logError("gorm:prometheus register callback err: %v", err)
+	}
+
+	if err := raw.After("*").Register(afterName, p.afterMigration); err != nil {
+		p.logError("gorm:prometheus register callback err: %v", err)
+	}
+}
+
+func (p *Prometheus) beforeMigration(db *gorm.DB) {
+	if p.migrationMetrics() == nil {
+		return
+	}
+
+	if _, _, ok := migrationLabels(db.Statement.SQL.String()); ok {
+		db.InstanceSet(migrationStartTimeInstance, p.now())
+	}
+}
+
+func (p *Prometheus) afterMigration(db *gorm.DB) {
+	value, ok := db.InstanceGet(migrationStartTimeInstance)
+	if !ok {
+		return
+	}
+
+	metrics := p.migrationMetrics()
+	startTime, ok := value.(time.Time)
+	if !ok || metrics == nil {
+		return
+	}
+
+	if operation, table, ok := migrationLabels(db.Statement.SQL.String()); ok {
+		metrics.MigrationDuration.WithLabelValues(operation, table).Observe(p.now().Sub(startTime).Seconds())
+	}
+}
+
+// migrationLabels returns the operation, e.g. create_table or create_index, and the table of the schema change sql,
+// ok is false if sql isn't one, the table is empty if sql doesn't name it, e.g. DROP INDEX on Postgres
+func migrationLabels(sql string) (operation, table string, ok bool) {
+	sql = strings.TrimSpace(sql)
+	verb := sql
+	if i := strings.IndexFunc(sql, unicode.IsSpace); i >= 0 {
+		verb = sql[:i]
+	}
+
+	verb = strings.ToLower(verb) // checked before splitting the whole sql, it is called for every raw statement
+	if verb != "create" && verb != "alter" && verb != "drop" {
+		return "", "", false
+	}
+
+	fields := strings.Fields(sql[len(verb):])
+	if len(fields) < 2 {
+		return "", "", false
+	}
+
+	if strings.EqualFold(fields[0], "unique") {
+		fields = fields[1:]
+	}
+
+	object := strings.ToLower(fields[0])
+	if object != "table" && object != "index" {
+		return "", "", false
+	}
+	fields = fields[1:]
+
+	for len(fields) > 0 && (strings.EqualFold(fields[0], "if") || strings.EqualFold(fields[0], "not") || strings.EqualFold(fields[0], "exists")) {
+		fields = fields[1:]
+	}
+
+	if object == "index" { // CREATE INDEX name ON table, DROP INDEX name ON table on MySQL
+		index := fields
+		fields = nil
+		for i, field := range index {
+			if strings.EqualFold(field, "on") {
+				fields = index[i+1:]
+				break
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		table = fields[0]
+		if i := strings.IndexByte(table, '('); i >= 0 {
+			table = table[:i]
+		}
+		table = unquoteTable.Replace(table) // "public"."users" too
+	}
+	return verb + "_" + object, table, true
+}
@@ -0,0 +1,40 @@
+package prometheus
+
+import "testing"
+
+func TestMigrationLabels(t *testing.T) {
+	for _, c := range []struct {
+		name, sql        string
+		operation, table string
+		ok               bool
+	}{
+		{"create table", "CREATE TABLE `users` (`id` bigint unsigned AUTO_INCREMENT,PRIMARY KEY (`id`))", "create_table", "users", true},
+		{"create table without space before the columns", "CREATE TABLE `users`(`id` bigint)", "create_table", "users", true},
+		{"create table if not exists", `CREATE TABLE IF NOT EXISTS "users" ("id" bigserial)`, "create_table", "users", true},
+		{"create table lowercase", "create table users (id int)", "create_table", "users", true},
+		{"create table of a schema", `CREATE TABLE "public"."users" ("id" bigserial)`, "create_table", "public.users", true},
+		{"create table on several lines", "CREATE\n\tTABLE [users]\n(id int);", "create_table", "users", true},
+		{"create index", "CREATE INDEX `idx_users_name` ON `users`(`name`)", "create_index", "users", true},
+		{"create unique index", "CREATE UNIQUE INDEX `idx_users_email` ON `users`(`email`)", "create_index", "users", true},
+		{"create index if not exists", `CREATE INDEX IF NOT EXISTS "idx_users_name" ON "users" ("name")`, "create_index", "users", true},
+		{"drop index on mysql", "DROP INDEX `idx_users_name` ON `users`", "drop_index", "users", true},
+		{"drop index on postgres", `DROP INDEX "idx_users_name"`, "drop_index", "", true},
+		{"drop table if exists", "DROP TABLE IF EXISTS `users` CASCADE", "drop_table", "users", true},
+		{"alter table", "ALTER TABLE `users` ADD `age` bigint", "alter_table", "users", true},
+		{"alter table drop column", `ALTER TABLE "users" DROP COLUMN "age"`, "alter_table", "users", true},
+		{"select", "SELECT * FROM `users`", "", "", false},
+		{"insert", "INSERT INTO `users` (`name`) VALUES (?)", "", "", false},
+		{"create view", "CREATE VIEW `active_users` AS SELECT * FROM `users`", "", "", false},
+		{"create temporary table", "CREATE TEMPORARY TABLE `tmp` (`id` int)", "", "", false},
+		{"alter database", "ALTER DATABASE `app` CHARACTER SET utf8mb4", "", "", false},
+		{"incomplete", "CREATE TABLE", "", "", false},
+		{"verb only", "DROP", "", "", false},
+		{"verb as a prefix", "CREATED TABLE `users`", "", "", false},
+		{"empty", "", "", "", false},
+	} {
+		operation, table, ok := migrationLabels(c.sql)
+		if operation != c.operation || table != c.table || ok != c.ok {
+			t.Errorf("%s: %q, %q, %t, expected %q, %q, %t", c.name, operation, table, ok, c.operation, c.table, c.ok)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package prometheus
 
 import (
-	"context"
 	"strconv"
 	"time"
 
@@ -20,19 +19,16 @@ func (m *MySQL) Metrics(p *Prometheus) []prometheus.Collector {
 		m.Prefix = "gorm_status_"
 	}
 
-	if m.Interval == 0 {
-		m.Interval = p.RefreshInterval
+	interval := time.Duration(m.Interval) * time.Second
+	if interval == 0 {
+		interval = p.Config.refreshDuration()
 	}
 
-	if m.status == nil {
-		m.status = map[string]prometheus.Gauge{}
-	}
+	m.status = map[string]prometheus.Gauge{} // the previous gauges were unregistered if the plugin was stopped
 
-	go func() {
-		for range time.Tick(time.Duration(m.Interval) * time.Second) {
-			m.collect(p)
-		}
-	}()
+	p.every(interval, false, func() {
+		m.collect(p)
+	})
 
 	m.collect(p)
 	collectors := make([]prometheus.Collector, 0, len(m.status))
@@ -45,10 +41,10 @@ func (m *MySQL) Metrics(p *Prometheus) []prometheus.Collector {
 }
 
 func (m *MySQL) collect(p *Prometheus) {
-	rows, err := p.DB.Raw("SHOW STATUS").Rows()
+	rows, err := p.db().Raw("SHOW STATUS").Rows()
 
 	if err != nil {
-		p.DB.Logger.Error(context.Background(), "gorm:prometheus query error: %v", err)
+		p.logError("gorm:prometheus query error: %v", err)
 		return
 	}
 
@@ -56,7 +52,7 @@ func (m *MySQL) collect(p *Prometheus) {
 	for rows.Next() {
 		err = rows.Scan(&variableName, &variableValue)
 		if err != nil {
-			p.DB.Logger.Error(context.Background(), "gorm:prometheus scan got error: %v", err)
+			p.logError("gorm:prometheus scan got error: %v", err)
 			continue
 		}
 
@@ -72,19 +68,26 @@ func (m *MySQL) collect(p *Prometheus) {
 		if found {
 			value, err := strconv.ParseFloat(variableValue, 64)
 			if err != nil {
-				p.DB.Logger.Error(context.Background(), "gorm:prometheus parse float got error: %v", err)
+				p.logError("gorm:prometheus parse float got error: %v", err)
 				continue
 			}
 
 			gauge, ok := m.status[variableName]
 			if !ok {
 				gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.Config.Namespace,
+					Subsystem:   p.Config.Subsystem,
 					Name:        m.Prefix + variableName,
-					ConstLabels: p.Labels,
+					ConstLabels: p.labels(),
 				})
 
+				if collector, err := p.register(gauge); err == nil {
+					if existing, ok := collector.(prometheus.Gauge); ok {
+						gauge = existing
+					}
+				}
+
 				m.status[variableName] = gauge
-				_ = prometheus.Register(gauge)
 			}
 
 			gauge.Set(value)
@@ -0,0 +1,90 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures the plugin created by NewWithOptions, any func(*Config) can be used for the fields without a With function
+type Option func(*Config)
+
+// NewWithOptions is like New, but configured by opts
+func NewWithOptions(opts ...Option) *Prometheus {
+	return NewWithContextOptions(context.Background(), opts...)
+}
+
+// NewWithContextOptions is like NewWithContext, but configured by opts
+func NewWithContextOptions(ctx context.Context, opts ...Option) *Prometheus {
+	var config Config
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return NewWithContext(ctx, config)
+}
+
+// WithDBName sets Config.DBName
+func WithDBName(name string) Option {
+	return func(config *Config) {
+		config.DBName = name
+	}
+}
+
+// WithConstLabels sets Config.ConstLabels
+func WithConstLabels(labels map[string]string) Option {
+	return func(config *Config) {
+		config.ConstLabels = labels
+	}
+}
+
+// WithRefreshInterval sets Config.RefreshDuration
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(config *Config) {
+		config.RefreshDuration = interval
+	}
+}
+
+// WithPushAddr sets Config.PushAddr
+func WithPushAddr(addr string) Option {
+	return func(config *Config) {
+		config.PushAddr = addr
+	}
+}
+
+// WithStartServer sets Config.StartServer and Config.HTTPServerPort
+func WithStartServer(port uint32) Option {
+	return func(config *Config) {
+		config.StartServer = true
+		config.HTTPServerPort = port
+	}
+}
+
+// WithMetricsCollector appends to Config.MetricsCollector
+func WithMetricsCollector(collectors ...MetricsCollector) Option {
+	return func(config *Config) {
+		config.MetricsCollector = append(config.MetricsCollector, collectors...)
+	}
+}
+
+// WithRegisterer sets Config.Registerer
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(config *Config) {
+		config.Registerer = registerer
+	}
+}
+
+// WithServeMux sets Config.ServeMux
+func WithServeMux(mux *http.ServeMux) Option {
+	return func(config *Config) {
+		config.ServeMux = mux
+	}
+}
+
+// WithInstrumentQueries sets Config.InstrumentQueries
+func WithInstrumentQueries() Option {
+	return func(config *Config) {
+		config.InstrumentQueries = true
+	}
+}
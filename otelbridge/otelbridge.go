@@ -0,0 +1,80 @@
+// Package otelbridge exports the db stats of the gorm:prometheus plugin through an OpenTelemetry meter.
+package otelbridge
+
+import (
+	"context"
+
+	"github.com/markus621/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Register registers observable instruments on meter reporting the db stats of the plugin's db and of the ones added with AddDB or WatchDB,
+// attributed with the labels of their metrics. The stats and the labels, e.g. changed by SetLabel, are read each time the meter's reader collects,
+// the plugin must be initialized before.
+// Unregister the returned registration to stop reporting.
+func Register(meter metric.Meter, p *prometheus.Prometheus) (metric.Registration, error) {
+	var (
+		gauges   = map[string]metric.Int64ObservableGauge{}
+		counters = map[string]metric.Int64ObservableCounter{}
+		waitTime metric.Float64ObservableCounter
+		err      error
+	)
+
+	for name, description := range map[string]string{
+		"gorm_dbstats_max_open_connections": "Maximum number of open connections to the database.",
+		"gorm_dbstats_open_connections":     "The number of established connections both in use and idle.",
+		"gorm_dbstats_in_use":               "The number of connections currently in use.",
+		"gorm_dbstats_idle":                 "The number of idle connections.",
+	} {
+		if gauges[name], err = meter.Int64ObservableGauge(name, metric.WithDescription(description)); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, description := range map[string]string{
+		"gorm_dbstats_wait_count":           "The total number of connections waited for.",
+		"gorm_dbstats_max_idle_closed":      "The total number of connections closed due to SetMaxIdleConns.",
+		"gorm_dbstats_max_idle_time_closed": "The total number of connections closed due to SetConnMaxIdleTime.",
+		"gorm_dbstats_max_lifetime_closed":  "The total number of connections closed due to SetConnMaxLifetime.",
+	} {
+		if counters[name], err = meter.Int64ObservableCounter(name, metric.WithDescription(description)); err != nil {
+			return nil, err
+		}
+	}
+
+	if waitTime, err = meter.Float64ObservableCounter("gorm_dbstats_wait_seconds",
+		metric.WithDescription("The total time blocked waiting for a new connection."), metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+
+	instruments := []metric.Observable{waitTime}
+	for _, gauge := range gauges {
+		instruments = append(instruments, gauge)
+	}
+	for _, counter := range counters {
+		instruments = append(instruments, counter)
+	}
+
+	return meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		for _, database := range p.Databases() {
+			attributes := make([]attribute.KeyValue, 0, len(database.Labels))
+			for k, v := range database.Labels {
+				attributes = append(attributes, attribute.String(k, v))
+			}
+			attributeSet := metric.WithAttributes(attributes...)
+
+			stats := database.DB.Stats()
+			observer.ObserveInt64(gauges["gorm_dbstats_max_open_connections"], int64(stats.MaxOpenConnections), attributeSet)
+			observer.ObserveInt64(gauges["gorm_dbstats_open_connections"], int64(stats.OpenConnections), attributeSet)
+			observer.ObserveInt64(gauges["gorm_dbstats_in_use"], int64(stats.InUse), attributeSet)
+			observer.ObserveInt64(gauges["gorm_dbstats_idle"], int64(stats.Idle), attributeSet)
+			observer.ObserveInt64(counters["gorm_dbstats_wait_count"], stats.WaitCount, attributeSet)
+			observer.ObserveInt64(counters["gorm_dbstats_max_idle_closed"], stats.MaxIdleClosed, attributeSet)
+			observer.ObserveInt64(counters["gorm_dbstats_max_idle_time_closed"], stats.MaxIdleTimeClosed, attributeSet)
+			observer.ObserveInt64(counters["gorm_dbstats_max_lifetime_closed"], stats.MaxLifetimeClosed, attributeSet)
+			observer.ObserveFloat64(waitTime, stats.WaitDuration.Seconds(), attributeSet)
+		}
+		return nil
+	}, instruments...)
+}
@@ -0,0 +1,187 @@
+package otelbridge_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/markus621/prometheus"
+	"github.com/markus621/prometheus/otelbridge"
+	client "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+const testDriverName = "gorm_prometheus_otelbridge_test"
+
+func init() {
+	sql.Register(testDriverName, testDriver{})
+}
+
+// testDriver is a database/sql driver whose connections can only be opened and closed, enough to read the db stats
+type testDriver struct{}
+
+func (testDriver) Open(string) (driver.Conn, error) {
+	return testConn{}, nil
+}
+
+type testConn struct{}
+
+func (testConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (testConn) Close() error {
+	return nil
+}
+
+func (testConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+// testDialector opens a gorm db backed by testDriver
+type testDialector struct{}
+
+func (testDialector) Name() string {
+	return "test"
+}
+
+func (testDialector) Initialize(db *gorm.DB) (err error) {
+	db.ConnPool, err = sql.Open(testDriverName, "")
+	return err
+}
+
+func (testDialector) Migrator(*gorm.DB) gorm.Migrator {
+	return nil
+}
+
+func (testDialector) DataTypeOf(field *schema.Field) string {
+	return string(field.DataType)
+}
+
+func (testDialector) DefaultValueOf(*schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+
+func (testDialector) BindVarTo(writer clause.Writer, _ *gorm.Statement, _ interface{}) {
+	writer.WriteByte('?')
+}
+
+func (testDialector) QuoteTo(writer clause.Writer, str string) {
+	writer.WriteString(str)
+}
+
+func (testDialector) Explain(sql string, _ ...interface{}) string {
+	return sql
+}
+
+// openTestDB opens a gorm db backed by testDriver allowing max open connections, closed at the end of the test
+func openTestDB(t *testing.T, max int) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(testDialector{}, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(max)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// observed collects reader, returning the data points of the int64 gauge name
+func observed(t *testing.T, reader sdkmetric.Reader, name string) []metricdata.DataPoint[int64] {
+	t.Helper()
+
+	var metrics metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	var points []metricdata.DataPoint[int64]
+	for _, scope := range metrics.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != name {
+				continue
+			}
+
+			gauge, ok := m.Data.(metricdata.Gauge[int64])
+			if !ok {
+				t.Fatalf("%s is a %T, expected an int64 gauge", name, m.Data)
+			}
+			points = append(points, gauge.DataPoints...)
+		}
+	}
+	return points
+}
+
+// byAttribute returns the values of points by the value of their attribute key
+func byAttribute(points []metricdata.DataPoint[int64], key attribute.Key) map[string]int64 {
+	values := map[string]int64{}
+	for _, point := range points {
+		value, _ := point.Attributes.Value(key)
+		values[value.AsString()] = point.Value
+	}
+	return values
+}
+
+func TestRegister(t *testing.T) {
+	p := prometheus.New(prometheus.Config{
+		DBName:          "db1",
+		Registerer:      client.NewRegistry(),
+		RefreshDuration: time.Hour,
+		ConstLabels:     map[string]string{"color": "blue"},
+	})
+	if err := openTestDB(t, 5).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := p.AddDB("db2", openTestDB(t, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+
+	registration, err := otelbridge.Register(provider.Meter("test"), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxOpen := byAttribute(observed(t, reader, "gorm_dbstats_max_open_connections"), "db_name")
+	if len(maxOpen) != 2 || maxOpen["db1"] != 5 || maxOpen["db2"] != 3 {
+		t.Errorf("max open connections %v by db_name, expected 5 for db1 and 3 for db2", maxOpen)
+	}
+
+	if err := p.SetLabel("color", "green"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, point := range observed(t, reader, "gorm_dbstats_max_open_connections") {
+		if color, _ := point.Attributes.Value("color"); color.AsString() != "green" {
+			t.Errorf("max open connections observed with color %s after SetLabel, expected green", color.AsString())
+		}
+	}
+
+	if err := registration.Unregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	if points := observed(t, reader, "gorm_dbstats_max_open_connections"); len(points) != 0 {
+		t.Errorf("%d max open connections observed after Unregister", len(points))
+	}
+}
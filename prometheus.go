@@ -2,26 +2,52 @@ package prometheus
 
 import (
 	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/model"
 	"gorm.io/gorm"
 )
 
 var (
 	_ gorm.Plugin = &Prometheus{}
+
+	defaultHistogramBuckets = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10} // seconds, db queries are often sub-millisecond
+
+	pluginLabelNames = []string{"operation", "table", "sql", "status", "class", "outcome", "version", "pool"} // the labels of the plugin's own metrics, see Config.validateLabels
 )
 
 const (
 	defaultRefreshInterval = 15   // the prometheus default pull metrics every 15 seconds
 	defaultHTTPServerPort  = 8080 // default pull port
+	defaultMetricsPath     = "/metrics"
+
+	defaultServerShutdownTimeout = 5 * time.Second // wait for in-flight scrapes before closing the http server
+	defaultPushRetryBackoff      = time.Second
+	defaultPushTimeout           = 5 * time.Second // a hanging pushgateway doesn't stall the push loop
+	defaultMaxSQLLabels          = 100
+	defaultMinInterval           = time.Second // shorter intervals hammer the db and the pushgateway
 )
 
+// MetricsCollector returns additional collectors registered and pushed along with the plugin's metrics,
+// they should have the labels of GetLabels as const labels for their series to join the plugin's ones, e.g. on db_name
 type MetricsCollector interface {
 	Metrics(*Prometheus) []prometheus.Collector
 }
@@ -29,22 +55,235 @@ type MetricsCollector interface {
 type Prometheus struct {
 	*gorm.DB
 	*DBStats
+	*QueryMetrics
+	*MigrationMetrics
+	*PluginMetrics
 	*Config
 	refreshOnce, pushOnce sync.Once
-	Labels                map[string]string
-	collectors            []prometheus.Collector
+	muxHandled            bool                   // the handler stays registered on Config.ServeMux across restarts, guarded by mu
+	Labels                map[string]string      // replaced, never modified, by Initialize under labelsMu
+	collectors            []prometheus.Collector // the ones of MetricsCollector, guarded by registeredMu
+
+	limitsMu sync.Mutex
+	limits   connLimits      // set by SetConnMaxLifetime and SetConnMaxIdleTime, kept across the DBStats created by Initialize and SetLabel
+	maxIdle  map[*sql.DB]int // set by SetMaxIdleConns and SetDBMaxIdleConns by connection pool, recorded in their DBStats by each refresh
+
+	metricsMu sync.RWMutex // guards DB and the metrics structs replaced by Initialize and SetLabel while the callbacks and the loops use them
+
+	labelsMu  sync.RWMutex
+	setLabels map[string]string // see SetLabel
+
+	registeredMu sync.Mutex
+	registered   []prometheus.Collector // collectors registered by the plugin, see Unregister
+
+	registeredCount int32 // len(registered), accessed atomically by PluginMetrics.Registered
+
+	handlerCollectors []prometheus.Collector // the metrics of the metrics handlers, see Handler, registered again by Initialize after Stop
+
+	addedMu sync.Mutex
+	added   []addedCollector // see AddCollector
+
+	parent context.Context // bounds the plugin lifetime, see NewWithContext
+	ctx    context.Context // cancelled by Stop to terminate background goroutines
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+
+	databasesMu sync.Mutex
+	databases   []*database // see AddDB
+
+	resolverPoolsMu sync.Mutex
+	resolverPools   []resolverPool // the dbresolver connection pools, in the order they were first seen
+
+	serverMu      sync.Mutex
+	serverStarted bool         // only one http server is started per plugin, until it is stopped
+	listener      net.Listener // bound by Initialize for the http server to serve on
+
+	tablesMu sync.Mutex
+	tables   map[string]bool // table labels seen, limited by Config.MaxTableLabels
+
+	sqlsMu sync.Mutex
+	sqls   map[string]bool // sql labels seen, limited by Config.MaxSQLLabels
+
+	unixClientsMu sync.Mutex
+	unixClients   map[string]*http.Client // dial the pushgateways over the unix domain sockets of the push addresses by socket
+
+	serverErr chan error // receives the error if the http server fails to serve
+	healthy   int32      // 1 if the last refresh of all the databases succeeded, accessed atomically
+	clock     clock      // source of time of the refresh and push loops and the query timings
+
+	statsUnsupported int32 // 1 if the connection pool of the plugin's db doesn't provide db stats, accessed atomically
+
+	failuresMu sync.Mutex
+	failures   map[string]bool // the recurring operations whose last run failed, see logFailure
 }
 
 type Config struct {
-	DBName           string             // use DBName as metrics label
-	RefreshInterval  uint32             // refresh metrics interval.
-	PushAddr         string             // prometheus pusher address
-	StartServer      bool               // if true, create http server to expose metrics
-	HTTPServerPort   uint32             // http server port
-	MetricsCollector []MetricsCollector // collector
+	DBName           string              // use DBName as metrics label
+	ConstLabels      map[string]string   // labels added to all the metrics, e.g. environment or region
+	InstanceLabel    string              // if set, label all the metrics with the hostname under this name, it is also a grouping label of the pushgateway
+	InstanceName     string              // value of InstanceLabel if the hostname is unknown
+	DriverLabel      string              // if set, label all the metrics with the name of the dialector, e.g. mysql or postgres, under this name
+	RefreshInterval  uint32              // refresh metrics interval in seconds.
+	RefreshDuration  time.Duration       // refresh metrics interval, takes precedence over RefreshInterval if set
+	MinInterval      time.Duration       // Initialize warns if the refresh or push interval is shorter, 1 second by default
+	Logger           *slog.Logger        // if set, log the errors of the plugin, e.g. of the refreshes and pushes, with it rather than the logger of the db
+	RefreshJitter    float64             // delay each refresh and push tick randomly by up to this fraction of the interval, between 0 and 1
+	PushAddr         string              // prometheus pusher address, unix:///path/to/socket pushes over a unix domain socket
+	PushAddrs        []string            // if set, also push to these addresses like PushAddr, e.g. to a primary and a DR pushgateway
+	PushJobName      string              // job name of the pushgateway, DBName is used if empty
+	PushInterval     uint32              // push metrics interval, RefreshInterval is used if zero
+	PushUsername     string              // basic auth username of the pushgateway
+	PushPassword     string              // basic auth password of the pushgateway
+	PushGrouping     map[string]string   // grouping labels of the pushgateway, a unique one (e.g. instance) is required if multiple instances push with the same job
+	PushHTTPClient   *http.Client        // http client of the pushgateway, e.g. to configure tls, its transport is replaced for a unix domain socket
+	PushUseAdd       bool                // if true, only replace the pushed metrics with the same names instead of all the metrics of the group
+	PushRetries      uint32              // retry a failed push up to this many times before the next interval, no retry by default
+	PushRetryBackoff time.Duration       // initial delay between the push retries, doubled after each of them
+	PushTimeout      time.Duration       // timeout of each push attempt, the Timeout of PushHTTPClient if not set, 5 seconds if neither is set
+	StartServer      bool                // if true, create http server to expose metrics, each plugin starts its own so plugins sharing a port fail to initialize
+	HTTPServerAddr   string              // http server host, listen on all interfaces if empty
+	HTTPServerPort   uint32              // http server port
+	MetricsPath      string              // path of the metrics handler on the http server or ServeMux
+	HealthPath       string              // if set, serve the health of the last refresh at HealthPath on the http server
+	MetricsCollector []MetricsCollector  // collector
+	EnabledStats     []string            // if set, only export the DBStats listed by field name, e.g. "OpenConnections"
+	PoolUtilization  bool                // if true, export the connections in use divided by the maximum open connections, also list it in EnabledStats if set
+	WaitObjectives   map[float64]float64 // if set, export the quantiles of the average wait per connection over each refresh with these objectives, also list WaitSummary in EnabledStats if set
+	Namespace        string              // namespace prepended to the metric names
+	Subsystem        string              // subsystem prepended to the metric names, after Namespace
+	MetricPrefix     string              // if set, prepended as is to the DBStats metric names, e.g. "myapp_" for gorm_dbstats_idle to become myapp_gorm_dbstats_idle
+
+	LogRepeatedErrors bool // if true, log every consecutive failure of a refresh or push at error level, by default only the first one until it recovers, the next ones at info level
+
+	InstrumentQueries  bool                   // if true, register callbacks to record the query metrics
+	Operations         []string               // if set, only instrument these operations among create, query, update, delete, row and raw, all of them by default
+	SlowQueryThreshold time.Duration          // if set, count the queries taking at least SlowQueryThreshold
+	ErrorClass         func(err error) string // class label of the query errors, ClassifyError if nil, only return values of a bounded set
+	TableLabel         bool                   // if true, label the query metrics by table, beware of the cardinality with dynamic table names
+	TableAllowlist     []string               // if set, the tables not in TableAllowlist are labeled "other"
+	MaxTableLabels     int                    // if set, the tables seen after the first MaxTableLabels ones are labeled "other"
+	HistogramBuckets   []float64              // buckets of the query duration histogram
+
+	NativeHistogramBucketFactor float64 // if greater than 1, also export the query duration as a native histogram, the growth factor of its buckets, e.g. 1.1
+	NativeHistogramMaxBuckets   uint32  // if set, the resolution of the native histogram is reduced once it has more buckets, unlimited by default
+
+	SummaryObjectives map[float64]float64 // if set, also export the quantiles of the query duration by operation with these objectives
+	SummaryMaxAge     time.Duration       // how long an observation counts in the quantiles, the prometheus default of 10 minutes if zero
+	DisableHistogram  bool                // if true, don't export the query duration histogram, e.g. to only export the summary
+	RowsBuckets       []float64           // if set, export the histogram of the number of rows returned by the query operations with these buckets, e.g. prometheus.ExponentialBuckets(1, 4, 8)
+
+	InstrumentMigrations bool // if true, register callbacks to record the duration of the schema changes, e.g. by AutoMigrate, independently of InstrumentQueries
+
+	// ContextLabels returns the values of the ContextLabelNames labels of the query metrics from the statement context, e.g. a tenant id.
+	// Every distinct value creates new series, so only return values of a bounded set, the values which aren't printable utf-8 are labeled "other".
+	ContextLabels     func(ctx context.Context) map[string]string
+	ContextLabelNames []string
+
+	// SQLLabel returns the value of the sql label of the query metrics from the sql of the statement, e.g. Fingerprint, disabled if nil.
+	// Every distinct value creates new series, so the values seen after the first MaxSQLLabels ones are labeled "other", like the ones which aren't printable utf-8.
+	SQLLabel     func(sql string) string
+	MaxSQLLabels int // 100 by default
+
+	// TraceID returns the trace id of the statement context, e.g. of its OpenTelemetry span, attached as an exemplar to the query duration histogram.
+	// Exemplars are only exposed in the OpenMetrics format, so they are only recorded if EnableOpenMetrics or HandlerOpts.EnableOpenMetrics is also true.
+	TraceID func(ctx context.Context) string
+
+	ServerShutdownTimeout time.Duration // how long to wait for in-flight scrapes when stopping the http server before closing them
+	DeleteOnShutdown      bool          // if true, delete the pushed metrics from the pushgateway on shutdown instead of pushing them a last time
+
+	Registerer prometheus.Registerer // register metrics with it instead of the default registry, it is also gathered by the http server if it implements prometheus.Gatherer
+	ServeMux   *http.ServeMux        // if set and StartServer is false, register the metrics handler at MetricsPath on it
+
+	HandlerOpts        *promhttp.HandlerOpts // options of the metrics handler, e.g. ErrorHandling or MaxRequestsInFlight, the promhttp defaults if nil
+	DisableCompression bool                  // if true, never gzip the metrics even if the scraper accepts it
+	EnableOpenMetrics  bool                  // if true, serve the OpenMetrics format to the scrapers requesting it, e.g. for exemplars, the text format otherwise
+
+	TLSCertFile string      // serve metrics over https, requires TLSKeyFile
+	TLSKeyFile  string      // serve metrics over https, requires TLSCertFile
+	TLSConfig   *tls.Config // optional tls config of the http server, serve metrics over https if set
+
+	BasicAuthUsername string // if set, the http server requires basic auth with BasicAuthUsername and BasicAuthPassword
+	BasicAuthPassword string
+}
+
+// Validate returns an error describing the first invalid option of config, it is called by Initialize
+func (config *Config) Validate() error {
+	if !validLabelValue(config.DBName) {
+		return fmt.Errorf("gorm:prometheus invalid DBName %q, expected printable utf-8", config.DBName)
+	}
+
+	for _, addr := range config.pushAddrs() {
+		if strings.HasPrefix(addr, unixSocketPrefix) {
+			continue
+		}
+
+		if u, err := url.Parse(addr); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("gorm:prometheus invalid push address %q, expected an http(s) url or unix:///path/to/socket", addr)
+		}
+	}
+
+	if config.RefreshJitter < 0 || config.RefreshJitter > 1 {
+		return fmt.Errorf("gorm:prometheus invalid RefreshJitter %v, expected a fraction between 0 and 1", config.RefreshJitter)
+	}
+
+	if config.RefreshDuration < 0 {
+		return fmt.Errorf("gorm:prometheus invalid RefreshDuration %s", config.RefreshDuration)
+	}
+
+	if config.PushTimeout < 0 {
+		return fmt.Errorf("gorm:prometheus invalid PushTimeout %s", config.PushTimeout)
+	}
+
+	if config.NativeHistogramBucketFactor != 0 && config.NativeHistogramBucketFactor <= 1 {
+		return fmt.Errorf("gorm:prometheus invalid NativeHistogramBucketFactor %v, expected greater than 1", config.NativeHistogramBucketFactor)
+	}
+
+	if config.MetricPrefix != "" && !model.IsValidMetricName(model.LabelValue(config.MetricPrefix+"gorm_dbstats")) {
+		return fmt.Errorf("gorm:prometheus invalid MetricPrefix %q", config.MetricPrefix)
+	}
+
+	if config.HTTPServerPort > 65535 {
+		return fmt.Errorf("gorm:prometheus invalid HTTPServerPort %d", config.HTTPServerPort)
+	}
+
+	if config.StartServer && config.ServeMux != nil {
+		return errors.New("gorm:prometheus StartServer and ServeMux are mutually exclusive")
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return errors.New("gorm:prometheus TLSCertFile and TLSKeyFile must be configured together")
+	}
+
+	if config.BasicAuthUsername == "" && config.BasicAuthPassword != "" {
+		return errors.New("gorm:prometheus BasicAuthPassword requires BasicAuthUsername")
+	}
+
+	if config.PushUsername == "" && config.PushPassword != "" {
+		return errors.New("gorm:prometheus PushPassword requires PushUsername")
+	}
+
+	if len(config.ContextLabelNames) > 0 && config.ContextLabels == nil {
+		return errors.New("gorm:prometheus ContextLabelNames requires ContextLabels")
+	}
+
+	if err := config.validateLabels(); err != nil {
+		return err
+	}
+
+	if err := validateOperations(config.Operations); err != nil {
+		return err
+	}
+
+	return validateStats(config.EnabledStats)
 }
 
 func New(config Config) *Prometheus {
+	return NewWithContext(context.Background(), config)
+}
+
+// NewWithContext is like New, but the background goroutines and the http server exit once ctx is done
+func NewWithContext(ctx context.Context, config Config) *Prometheus {
 	if config.RefreshInterval == 0 {
 		config.RefreshInterval = defaultRefreshInterval
 	}
@@ -53,7 +292,31 @@ func New(config Config) *Prometheus {
 		config.HTTPServerPort = defaultHTTPServerPort
 	}
 
-	return &Prometheus{Config: &config, Labels: make(map[string]string)}
+	if config.MetricsPath == "" {
+		config.MetricsPath = defaultMetricsPath
+	}
+
+	if len(config.HistogramBuckets) == 0 {
+		config.HistogramBuckets = defaultHistogramBuckets
+	}
+
+	if config.ServerShutdownTimeout == 0 {
+		config.ServerShutdownTimeout = defaultServerShutdownTimeout
+	}
+
+	if config.SQLLabel != nil && config.MaxSQLLabels == 0 {
+		config.MaxSQLLabels = defaultMaxSQLLabels
+	}
+
+	if config.MinInterval == 0 {
+		config.MinInterval = defaultMinInterval
+	}
+
+	if config.PushRetryBackoff == 0 {
+		config.PushRetryBackoff = defaultPushRetryBackoff
+	}
+
+	return &Prometheus{Config: &config, Labels: make(map[string]string), parent: ctx, serverErr: make(chan error, 1), clock: realClock{}}
 }
 
 func (p *Prometheus) Name() string {
@@ -61,75 +324,610 @@ func (p *Prometheus) Name() string {
 }
 
 func (p *Prometheus) Initialize(db *gorm.DB) error { //can be called repeatedly
+	if err := p.Config.Validate(); err != nil {
+		return err
+	}
+
+	if p.Config.StartServer {
+		if err := p.listen(); err != nil { // before anything is started, so that nothing is left running
+			return err
+		}
+	} else if p.Config.ServeMux != nil {
+		if err := p.checkServeMux(); err != nil {
+			return err
+		}
+	}
+
+	p.metricsMu.Lock()
 	p.DB = db
+	p.metricsMu.Unlock()
+
+	labels := p.labels()
+	for name, value := range p.Config.ConstLabels {
+		labels[name] = value
+	}
+
+	if p.Config.InstanceLabel != "" {
+		labels[p.Config.InstanceLabel] = instanceName(p.Config.InstanceName)
+	}
+
+	if p.Config.DriverLabel != "" && db.Dialector != nil {
+		labels[p.Config.DriverLabel] = db.Dialector.Name()
+	}
 
 	if p.Config.DBName != "" {
-		p.Labels["db_name"] = p.Config.DBName
+		labels["db_name"] = p.Config.DBName
+	}
+
+	p.labelsMu.Lock()
+	for name, value := range p.setLabels {
+		labels[name] = value
+	}
+	p.Labels = labels
+	p.labelsMu.Unlock()
+
+	if err := p.newMetrics(labels); err != nil {
+		p.closeListener()
+		return err
+	}
+	p.registerDatabases()
+	p.registerAdded()
+	p.registerHandlerCollectors()
+
+	if p.Config.InstrumentQueries {
+		p.registerCallbacks(db)
+		p.instrumentTransactions(db)
+	}
+
+	if p.Config.InstrumentMigrations {
+		p.registerMigrationCallbacks(db)
 	}
 
-	p.DBStats = newStats(p.Labels)
+	p.mu.Lock()
+	if p.ctx == nil {
+		p.ctx, p.cancel = context.WithCancel(p.parent)
+	}
+	p.mu.Unlock()
 
 	p.refreshOnce.Do(func() {
-		for _, mc := range p.MetricsCollector {
-			p.collectors = append(p.collectors, mc.Metrics(p)...)
+		if interval := p.Config.refreshDuration(); interval < p.Config.MinInterval {
+			p.logWarn("gorm:prometheus refresh interval %s is shorter than %s, the db stats are read that often", interval, p.Config.MinInterval)
 		}
 
-		go func() {
-			for range time.Tick(time.Duration(p.Config.RefreshInterval) * time.Second) {
-				p.refresh()
+		for _, mc := range p.MetricsCollector {
+			var collectors []prometheus.Collector
+			p.safely(func() { collectors = mc.Metrics(p) }) // a panicking one doesn't prevent the refresh loop from starting
+
+			for _, collector := range collectors {
+				registered, err := p.register(collector) // expose them to scrapes too, not only to the pushgateway
+				if err != nil {
+					p.logError("gorm:prometheus failed to register collector, got error: %v", err)
+					continue
+				}
+				p.registeredMu.Lock()
+				p.collectors = append(p.collectors, registered)
+				p.registeredMu.Unlock()
 			}
-		}()
+		}
+
+		p.safely(p.refresh) // don't expose zero values until the first tick
+		p.every(p.Config.refreshDuration(), false, p.refresh)
 	})
 
 	if p.Config.StartServer {
-		go p.startServer()
+		p.startServer()
+	} else if p.Config.ServeMux != nil {
+		p.handleServeMux()
 	}
 
-	if p.PushAddr != "" {
-		go p.startPush()
+	if len(p.Config.pushAddrs()) > 0 {
+		p.startPush()
 	}
 
 	return nil
 }
 
-func (p *Prometheus) refresh() {
-	if db, err := p.DB.DB(); err == nil {
-		p.DBStats.Set(db.Stats())
-	} else {
-		p.DB.Logger.Error(context.Background(), "gorm:prometheus failed to collect db status, got error: %v", err)
+// Stop terminates the background goroutines and shuts down the http server, it is safe to call repeatedly.
+// Cancelling the context passed to NewWithContext has the same effect, except that Stop also waits for them to exit.
+// The plugin can be started again by calling Initialize.
+func (p *Prometheus) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ctx == nil {
+		return
 	}
+
+	p.cancel()
+	p.wg.Wait()
+	p.Unregister()
+	p.ctx, p.cancel = nil, nil
+
+	p.resolverPoolsMu.Lock()
+	p.resolverPools = nil
+	p.resolverPoolsMu.Unlock()
+
+	p.registeredMu.Lock()
+	p.collectors = nil
+	p.registeredMu.Unlock()
+
+	p.closeUnixClients() // after the last push or delete on Stop
+	p.refreshOnce, p.pushOnce = sync.Once{}, sync.Once{}
 }
 
-func (p *Prometheus) startPush() {
-	p.pushOnce.Do(func() {
-		pusher := push.New(p.PushAddr, p.DBName)
+// every calls fn on each interval tick until the plugin is stopped, and right away if immediately is true
+func (p *Prometheus) every(interval time.Duration, immediately bool, fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		for _, collector := range p.DBStats.Collectors() {
-			pusher = pusher.Collector(collector)
-		}
+	if p.ctx == nil {
+		return
+	}
+
+	p.wg.Add(1)
+	go func(ctx context.Context) {
+		defer p.wg.Done()
+
+		ticker := p.clock.NewTicker(interval)
+		defer ticker.Stop()
 
-		for _, c := range p.collectors {
-			pusher = pusher.Collector(c)
+		if immediately {
+			p.safely(fn)
 		}
 
-		for range time.Tick(time.Duration(p.Config.RefreshInterval) * time.Second) {
-			err := pusher.Push()
-			if err != nil {
-				p.DB.Logger.Error(context.Background(), "gorm:prometheus push err: ", err)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				if p.Config.RefreshJitter > 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-p.clock.After(time.Duration(rand.Float64() * p.Config.RefreshJitter * float64(interval))):
+					}
+				}
+
+				if ctx.Err() == nil {
+					p.safely(fn)
+				}
 			}
 		}
+	}(p.ctx)
+}
+
+// onStop calls fn once the plugin is stopped
+func (p *Prometheus) onStop(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ctx == nil {
+		return
+	}
+
+	p.wg.Add(1)
+	go func(ctx context.Context) {
+		defer p.wg.Done()
+		<-ctx.Done()
+		p.safely(fn)
+	}(p.ctx)
+}
+
+// safely calls fn, logging and counting its panic if any
+func (p *Prometheus) safely(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.pluginMetrics().Panics.Inc()
+			p.logError("gorm:prometheus recovered from panic: %v", r)
+		}
+	}()
+
+	fn()
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections of the plugin's db, reported by MaxIdleConnections since database/sql doesn't expose it
+func (p *Prometheus) SetMaxIdleConns(n int) error {
+	if p.db() == nil {
+		return errors.New("gorm:prometheus the plugin must be initialized before setting the maximum number of idle connections")
+	}
+
+	db, err := p.db().DB()
+	if err != nil {
+		return err
+	}
+	return p.SetDBMaxIdleConns(db, n)
+}
+
+// SetDBMaxIdleConns sets the maximum number of idle connections of db, reported by the MaxIdleConnections of its stats from the next refresh
+// whether it is the plugin's db, one added with AddDB or WatchDB or a connection pool of dbresolver, since database/sql doesn't expose it.
+// The maximum number of idle connections set with db.SetMaxIdleConns instead isn't exported.
+func (p *Prometheus) SetDBMaxIdleConns(db *sql.DB, n int) error {
+	if db == nil {
+		return errors.New("gorm:prometheus SetDBMaxIdleConns requires a db")
+	}
+
+	db.SetMaxIdleConns(n)
+	if n < 0 {
+		n = 0
+	}
+
+	p.limitsMu.Lock()
+	defer p.limitsMu.Unlock()
+
+	if p.maxIdle == nil {
+		p.maxIdle = map[*sql.DB]int{}
+	}
+	p.maxIdle[db] = n
+	return nil
+}
+
+// setStats sets stats to the stats of db, with the maximum number of idle connections set on it if any
+func (p *Prometheus) setStats(stats *DBStats, db *sql.DB) {
+	p.limitsMu.Lock()
+	maxIdle, ok := p.maxIdle[db]
+	p.limitsMu.Unlock()
+
+	if ok {
+		stats.setMaxIdle(&maxIdle)
+	} else {
+		stats.setMaxIdle(nil)
+	}
+	stats.Set(db.Stats())
+}
+
+// SetConnMaxLifetime sets the maximum lifetime of the connections of the plugin's db, reported by ConnMaxLifetime since database/sql doesn't expose it
+func (p *Prometheus) SetConnMaxLifetime(d time.Duration) error {
+	if p.db() == nil {
+		return errors.New("gorm:prometheus the plugin must be initialized before setting the maximum lifetime of the connections")
+	}
+
+	db, err := p.db().DB()
+	if err != nil {
+		return err
+	}
+
+	db.SetConnMaxLifetime(d)
+	p.setLimits(func(limits *connLimits) {
+		if d < 0 {
+			d = 0
+		}
+		limits.maxLifetime = &d
 	})
+	return nil
 }
 
-var httpServerOnce sync.Once
+// SetConnMaxIdleTime sets the maximum idle time of the connections of the plugin's db, reported by ConnMaxIdleTime since database/sql doesn't expose it
+func (p *Prometheus) SetConnMaxIdleTime(d time.Duration) error {
+	if p.db() == nil {
+		return errors.New("gorm:prometheus the plugin must be initialized before setting the maximum idle time of the connections")
+	}
 
-func (p *Prometheus) startServer() {
-	httpServerOnce.Do(func() { //only start once
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(fmt.Sprintf(":%d", p.Config.HTTPServerPort), mux)
-		if err != nil {
-			p.DB.Logger.Error(context.Background(), "gorm:prometheus listen and serve err: ", err)
+	db, err := p.db().DB()
+	if err != nil {
+		return err
+	}
+
+	db.SetConnMaxIdleTime(d)
+	p.setLimits(func(limits *connLimits) {
+		if d < 0 {
+			d = 0
 		}
+		limits.maxIdleTime = &d
 	})
+	return nil
+}
+
+// setLimits updates the limits set on the connections of the plugin's db and records them in its DBStats
+func (p *Prometheus) setLimits(update func(*connLimits)) {
+	p.limitsMu.Lock()
+	defer p.limitsMu.Unlock()
+
+	update(&p.limits)
+	p.dbStats().setLimits(p.limits)
+}
+
+// newMetrics creates and registers the metrics of the plugin with labels, it returns the errors of the ones failing to register
+func (p *Prometheus) newMetrics(labels map[string]string) error {
+	pluginMetrics := newPluginMetrics(labels, p.Config, func() float64 {
+		return float64(atomic.LoadInt32(&p.registeredCount))
+	})
+	errs := pluginMetrics.register(p.register)
+
+	stats, err := newStats(statsPrefix, labels, p.Config).register(p.register)
+	errs = errors.Join(errs, err)
+
+	var queryMetrics *QueryMetrics
+	if p.Config.InstrumentQueries {
+		queryMetrics = newQueryMetrics(labels, p.Config)
+		errs = errors.Join(errs, queryMetrics.register(p.register))
+	}
+
+	var migrationMetrics *MigrationMetrics
+	if p.Config.InstrumentMigrations {
+		migrationMetrics = newMigrationMetrics(labels, p.Config)
+		errs = errors.Join(errs, migrationMetrics.register(p.register))
+	}
+
+	p.limitsMu.Lock() // so that the limits set meanwhile aren't recorded in the previous DBStats only
+	defer p.limitsMu.Unlock()
+	stats.setLimits(p.limits) // set before SetLabel or Stop must still be reported
+
+	p.metricsMu.Lock()
+	p.PluginMetrics, p.DBStats, p.QueryMetrics, p.MigrationMetrics = pluginMetrics, stats, queryMetrics, migrationMetrics
+	p.metricsMu.Unlock()
+	return errs
+}
+
+// db returns the plugin's db, nil until Initialize
+func (p *Prometheus) db() *gorm.DB {
+	p.metricsMu.RLock()
+	defer p.metricsMu.RUnlock()
+	return p.DB
+}
+
+// dbStats returns the db stats of the plugin's db, replaced by Initialize and SetLabel
+func (p *Prometheus) dbStats() *DBStats {
+	p.metricsMu.RLock()
+	defer p.metricsMu.RUnlock()
+	return p.DBStats
+}
+
+// queryMetrics returns the query metrics, replaced by Initialize and SetLabel, nil unless Config.InstrumentQueries is true
+func (p *Prometheus) queryMetrics() *QueryMetrics {
+	p.metricsMu.RLock()
+	defer p.metricsMu.RUnlock()
+	return p.QueryMetrics
+}
+
+// pluginMetrics returns the metrics of the plugin itself, replaced by Initialize and SetLabel
+func (p *Prometheus) pluginMetrics() *PluginMetrics {
+	p.metricsMu.RLock()
+	defer p.metricsMu.RUnlock()
+	return p.PluginMetrics
+}
+
+// migrationMetrics returns the migration metrics, replaced by Initialize and SetLabel, nil unless Config.InstrumentMigrations is true
+func (p *Prometheus) migrationMetrics() *MigrationMetrics {
+	p.metricsMu.RLock()
+	defer p.metricsMu.RUnlock()
+	return p.MigrationMetrics
+}
+
+// GetLabels returns a copy of the labels of the plugin's metrics, e.g. db_name, to add them to the collectors of a MetricsCollector
+func (p *Prometheus) GetLabels() map[string]string {
+	return p.labels()
+}
+
+// labels returns a copy of Labels
+func (p *Prometheus) labels() map[string]string {
+	p.labelsMu.RLock()
+	defer p.labelsMu.RUnlock()
+
+	labels := make(map[string]string, len(p.Labels)+1)
+	for k, v := range p.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// validateLabels returns an error if a label name of config is invalid or is already the name of another label of the metrics
+func (config *Config) validateLabels() error {
+	options := map[string]string{"db_name": "DBName"} // the option each label name is used by
+	for _, name := range pluginLabelNames {
+		options[name] = "the plugin"
+	}
+
+	use := func(name, option string) error {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("gorm:prometheus invalid label name %q in %s", name, option)
+		}
+
+		if other, ok := options[name]; ok {
+			return fmt.Errorf("gorm:prometheus label %q of %s is already a label of %s", name, option, other)
+		}
+		options[name] = option
+		return nil
+	}
+
+	constLabels := make([]string, 0, len(config.ConstLabels))
+	for name := range config.ConstLabels {
+		constLabels = append(constLabels, name)
+	}
+	sort.Strings(constLabels) // report the same error each time
+
+	for _, name := range constLabels {
+		if err := use(name, "ConstLabels"); err != nil {
+			return err
+		}
+	}
+
+	if config.InstanceLabel != "" {
+		if err := use(config.InstanceLabel, "InstanceLabel"); err != nil {
+			return err
+		}
+	}
+
+	if config.DriverLabel != "" {
+		if err := use(config.DriverLabel, "DriverLabel"); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range config.ContextLabelNames {
+		if err := use(name, "ContextLabelNames"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openMetrics reports whether the metrics handler serves the OpenMetrics format, EnableOpenMetrics or HandlerOpts.EnableOpenMetrics
+func (config *Config) openMetrics() bool {
+	return config.EnableOpenMetrics || (config.HandlerOpts != nil && config.HandlerOpts.EnableOpenMetrics)
+}
+
+// pushAddrs returns PushAddr, if set, and PushAddrs
+func (config *Config) pushAddrs() []string {
+	addrs := make([]string, 0, len(config.PushAddrs)+1)
+	if config.PushAddr != "" {
+		addrs = append(addrs, config.PushAddr)
+	}
+	return append(addrs, config.PushAddrs...)
+}
+
+// pushTimeout returns PushTimeout, or the Timeout of PushHTTPClient if it isn't set, or the default if neither is set
+func (config *Config) pushTimeout() time.Duration {
+	if config.PushTimeout > 0 {
+		return config.PushTimeout
+	}
+
+	if config.PushHTTPClient != nil && config.PushHTTPClient.Timeout > 0 {
+		return config.PushHTTPClient.Timeout
+	}
+	return defaultPushTimeout
+}
+
+// refreshDuration returns RefreshDuration, or RefreshInterval if it isn't set
+func (config *Config) refreshDuration() time.Duration {
+	if config.RefreshDuration > 0 {
+		return config.RefreshDuration
+	}
+	return time.Duration(config.RefreshInterval) * time.Second
+}
+
+// validLabelValue reports whether value is valid utf-8 without control characters, which scrapers and dashboards may mangle
+func validLabelValue(value string) bool {
+	if !utf8.ValidString(value) {
+		return false
+	}
+
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// instanceName returns the hostname, or fallback if it is unknown
+func instanceName(fallback string) string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return fallback
+}
+
+// Registry returns the registerer the plugin registers its metrics with, Config.Registerer or the default registry,
+// register your own collectors with it to expose them along with the plugin's, it is safe for concurrent use
+func (p *Prometheus) Registry() prometheus.Registerer {
+	if p.Config.Registerer != nil {
+		return p.Config.Registerer
+	}
+	return prometheus.DefaultRegisterer
+}
+
+// register registers the collector and keeps track of it for Unregister.
+// If an equal collector is already registered, e.g. by another plugin using the same registry and labels, it is returned to be used instead.
+func (p *Prometheus) register(collector prometheus.Collector) (prometheus.Collector, error) {
+	if err := p.Registry().Register(collector); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector, nil
+		}
+		return nil, err
+	}
+
+	p.registeredMu.Lock()
+	p.registered = append(p.registered, collector)
+	atomic.StoreInt32(&p.registeredCount, int32(len(p.registered)))
+	p.registeredMu.Unlock()
+	return collector, nil
+}
+
+// unregister unregisters collector and forgets it for Unregister, it returns false if it wasn't registered
+func (p *Prometheus) unregister(collector prometheus.Collector) bool {
+	p.registeredMu.Lock()
+	for i, c := range p.registered {
+		if c == collector {
+			p.registered = append(p.registered[:i], p.registered[i+1:]...)
+			atomic.StoreInt32(&p.registeredCount, int32(len(p.registered)))
+			break
+		}
+	}
+	p.registeredMu.Unlock()
+
+	return p.Registry().Unregister(collector)
+}
+
+// Unregister unregisters all the collectors registered by the plugin and the ones returned by MetricsCollector, it is called by Stop
+func (p *Prometheus) Unregister() {
+	p.registeredMu.Lock()
+	defer p.registeredMu.Unlock()
+
+	for _, collector := range append(p.registered, p.collectors...) {
+		p.Registry().Unregister(collector)
+	}
+	p.registered = nil
+	atomic.StoreInt32(&p.registeredCount, 0)
+}
+
+// Gatherer returns the gatherer the metrics handler serves, Registry if it is a prometheus.Gatherer or the default registry,
+// e.g. to gather the metrics manually or merge them with prometheus.Gatherers, it is safe for concurrent use
+func (p *Prometheus) Gatherer() prometheus.Gatherer {
+	if gatherer, ok := p.Registry().(prometheus.Gatherer); ok {
+		return gatherer
+	}
+	return prometheus.DefaultGatherer
+}
+
+// Refresh refreshes the db stats now rather than at the next tick, e.g. right before exporting them in a short script,
+// it returns the errors of the databases whose stats couldn't be collected
+func (p *Prometheus) Refresh() (err error) {
+	if p.db() == nil || p.dbStats() == nil {
+		return errors.New("gorm:prometheus the plugin must be initialized before refreshing the db stats")
+	}
+
+	p.safely(func() { err = p.collect() })
+	return err
+}
+
+// Snapshot returns the db stats of the plugin's db as of the last refresh, the zero value before Initialize,
+// it is safe to call concurrently with the refresh, SetLabel and Initialize, which replace the stats
+func (p *Prometheus) Snapshot() sql.DBStats {
+	if stats := p.dbStats(); stats != nil {
+		return stats.Snapshot()
+	}
+	return sql.DBStats{}
+}
+
+// refresh refreshes the db stats, the errors are already logged by collect
+func (p *Prometheus) refresh() {
+	_ = p.collect()
+}
+
+// collect refreshes the db stats and the health, it returns the errors of the databases whose stats couldn't be collected
+func (p *Prometheus) collect() error {
+	err := p.refreshDatabases()
+	gormDB, stats, pluginMetrics := p.db(), p.dbStats(), p.pluginMetrics()
+	if db, dbErr := gormDB.DB(); dbErr == nil {
+		p.setStats(stats, db)
+		stats.setPreparedStatements(gormDB.ConnPool)
+		p.refreshResolverPools()
+		pluginMetrics.StatsUnsupported.Set(0)
+		atomic.StoreInt32(&p.statsUnsupported, 0)
+	} else {
+		// gorm only fails to return the *sql.DB of connection pools not backed by one, e.g. a custom pool, so trying again won't help
+		pluginMetrics.StatsUnsupported.Set(1)
+		stats.refreshFailed()
+		if atomic.SwapInt32(&p.statsUnsupported, 1) == 0 { // logged once
+			p.logError("gorm:prometheus the connection pool %T doesn't provide db stats, they won't be reported until it does, got error: %v", gormDB.ConnPool, dbErr)
+		}
+		err = errors.Join(err, fmt.Errorf("gorm:prometheus the connection pool %T doesn't provide db stats: %w", gormDB.ConnPool, dbErr))
+	}
+
+	if err == nil {
+		atomic.StoreInt32(&p.healthy, 1)
+	} else {
+		atomic.StoreInt32(&p.healthy, 0)
+	}
+	return err
 }
@@ -0,0 +1,453 @@
+package prometheus
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/migrator"
+	"gorm.io/gorm/schema"
+)
+
+const testDriverName = "gorm_prometheus_test"
+
+func init() {
+	sql.Register(testDriverName, testDriver{})
+}
+
+// testDriver is a database/sql driver accepting any statement without a database, every exec affects one row and every query returns no rows
+type testDriver struct{}
+
+func (testDriver) Open(string) (driver.Conn, error) {
+	return testConn{}, nil
+}
+
+type testConn struct{}
+
+func (testConn) Prepare(string) (driver.Stmt, error) {
+	return testStmt{}, nil
+}
+
+func (testConn) Close() error {
+	return nil
+}
+
+func (testConn) Begin() (driver.Tx, error) {
+	return testTx{}, nil
+}
+
+type testStmt struct{}
+
+func (testStmt) Close() error {
+	return nil
+}
+
+func (testStmt) NumInput() int {
+	return -1
+}
+
+func (testStmt) Exec([]driver.Value) (driver.Result, error) {
+	return testResult{}, nil
+}
+
+func (testStmt) Query([]driver.Value) (driver.Rows, error) {
+	return testRows{}, nil
+}
+
+type testResult struct{}
+
+func (testResult) LastInsertId() (int64, error) {
+	return 1, nil
+}
+
+func (testResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type testRows struct{}
+
+func (testRows) Columns() []string {
+	return nil
+}
+
+func (testRows) Close() error {
+	return nil
+}
+
+func (testRows) Next([]driver.Value) error {
+	return io.EOF
+}
+
+type testTx struct{}
+
+func (testTx) Commit() error {
+	return nil
+}
+
+func (testTx) Rollback() error {
+	return nil
+}
+
+// testDialector opens a gorm db backed by testDriver
+type testDialector struct{}
+
+func (testDialector) Name() string {
+	return "test"
+}
+
+func (testDialector) Initialize(db *gorm.DB) (err error) {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	db.ConnPool, err = sql.Open(testDriverName, "")
+	return err
+}
+
+func (dialector testDialector) Migrator(db *gorm.DB) gorm.Migrator {
+	return migrator.Migrator{Config: migrator.Config{DB: db, Dialector: dialector}}
+}
+
+func (testDialector) DataTypeOf(field *schema.Field) string {
+	return string(field.DataType)
+}
+
+func (testDialector) DefaultValueOf(*schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+
+func (testDialector) BindVarTo(writer clause.Writer, _ *gorm.Statement, _ interface{}) {
+	writer.WriteByte('?')
+}
+
+func (testDialector) QuoteTo(writer clause.Writer, str string) {
+	writer.WriteByte('"')
+	writer.WriteString(str)
+	writer.WriteByte('"')
+}
+
+func (testDialector) Explain(sql string, _ ...interface{}) string {
+	return sql
+}
+
+// openTestDB opens a gorm db backed by testDriver, closed at the end of the test
+func openTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(testDialector{}, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// gather returns the metric families of gatherer by name
+func gather(t testing.TB, gatherer prometheus.Gatherer) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+// waitFor fails the test unless cond becomes true within a second
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestStopReleasesGoroutines(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}} // no idle connection goroutine is left behind
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		db, err := gorm.Open(testDialector{}, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := NewWithContext(context.Background(), Config{
+			DBName:          "db1",
+			Registerer:      prometheus.NewRegistry(),
+			RefreshDuration: time.Millisecond,
+			MinInterval:     time.Millisecond,
+			PushAddr:        gateway.URL,
+			PushHTTPClient:  client,
+		})
+		if err := db.Use(p); err != nil {
+			t.Fatal(err)
+		}
+
+		p.Stop()
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	}
+
+	waitFor(t, "the goroutines to exit", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+// gaugeCollector returns a gauge as the collector of MetricsCollector
+type gaugeCollector struct {
+	gauge prometheus.Gauge
+}
+
+func (c gaugeCollector) Metrics(*Prometheus) []prometheus.Collector {
+	return []prometheus.Collector{c.gauge}
+}
+
+func TestUnregisterAndRegisterAgain(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	collector := gaugeCollector{prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_custom"})}
+	p := New(Config{DBName: "db1", Registerer: registry, InstrumentQueries: true, HandlerOpts: &promhttp.HandlerOpts{}, MetricsCollector: []MetricsCollector{collector}})
+
+	db := openTestDB(t)
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	p.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	expected := []string{"gorm_dbstats_open_connections", "gorm_prometheus_build_info", "test_custom", "promhttp_metric_handler_requests_total"}
+	families := gather(t, registry)
+	for _, name := range expected {
+		if families[name] == nil {
+			t.Fatalf("%s isn't registered", name)
+		}
+	}
+
+	p.Stop()
+	if families := gather(t, registry); len(families) != 0 {
+		t.Fatalf("%d metrics are still registered after Stop", len(families))
+	}
+
+	if err := p.Initialize(db); err != nil {
+		t.Fatalf("Initialize after Stop: %v", err)
+	}
+
+	families = gather(t, registry)
+	for _, name := range expected {
+		if families[name] == nil {
+			t.Fatalf("%s isn't registered again", name)
+		}
+	}
+
+	p.Stop()
+	other := New(Config{DBName: "db1", Registerer: registry, InstrumentQueries: true})
+	if err := openTestDB(t).Use(other); err != nil {
+		t.Fatalf("another plugin on the same registry: %v", err)
+	}
+	other.Stop()
+}
+
+func TestValidateLabels(t *testing.T) {
+	contextLabels := func(context.Context) map[string]string { return nil }
+	for _, config := range []Config{
+		{ConstLabels: map[string]string{"bad-name": "x"}},
+		{ConstLabels: map[string]string{"__name": "x"}},
+		{ConstLabels: map[string]string{"status": "x"}},
+		{ConstLabels: map[string]string{"db_name": "x"}},
+		{InstanceLabel: "operation"},
+		{InstanceLabel: "host", DriverLabel: "host"},
+		{ConstLabels: map[string]string{"tenant": "x"}, ContextLabels: contextLabels, ContextLabelNames: []string{"tenant"}},
+		{ContextLabels: contextLabels, ContextLabelNames: []string{"tenant", "tenant"}},
+		{ContextLabels: contextLabels, ContextLabelNames: []string{"class"}},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("%+v is valid", config)
+		}
+	}
+
+	valid := Config{
+		DBName:            "db1",
+		ConstLabels:       map[string]string{"region": "eu"},
+		InstanceLabel:     "instance",
+		DriverLabel:       "driver",
+		ContextLabels:     contextLabels,
+		ContextLabelNames: []string{"tenant"},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("%+v is invalid: %v", valid, err)
+	}
+
+	p := New(Config{ConstLabels: map[string]string{"bad-name": "x"}, Registerer: prometheus.NewRegistry()})
+	if err := openTestDB(t).Use(p); err == nil {
+		p.Stop()
+		t.Error("db.Use succeeded with an invalid const label name")
+	}
+}
+
+// panickingCollector panics instead of returning its collectors
+type panickingCollector struct{}
+
+func (panickingCollector) Metrics(*Prometheus) []prometheus.Collector {
+	panic("no collectors")
+}
+
+func TestPanicsAreRecovered(t *testing.T) {
+	p := New(Config{
+		DBName:           "db1",
+		Registerer:       prometheus.NewRegistry(),
+		RefreshDuration:  time.Millisecond,
+		MinInterval:      time.Millisecond,
+		MetricsCollector: []MetricsCollector{panickingCollector{}},
+	})
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	var refreshes int32
+	if err := p.addDatabase("panicking", "", func() (*sql.DB, error) {
+		atomic.AddInt32(&refreshes, 1)
+		panic("no db")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the refresh loop to survive its panics", func() bool {
+		return atomic.LoadInt32(&refreshes) >= 3
+	})
+
+	if panics := testutil.ToFloat64(p.PluginMetrics.Panics); panics < 4 { // the collector's and the refreshes'
+		t.Errorf("%v panics counted, expected at least 4", panics)
+	}
+}
+
+func TestInitializeRepeatedly(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p := New(Config{
+		DBName:               "db1",
+		Registerer:           registry,
+		RefreshDuration:      time.Millisecond,
+		MinInterval:          time.Millisecond,
+		InstrumentQueries:    true,
+		InstrumentMigrations: true,
+	})
+	db := openTestDB(t)
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { // the queries and the refresh loop use the metrics while Initialize replaces them
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				db.Exec("SELECT 1")
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, _ = registry.Gather()
+				_ = p.Collectors()
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		if err := p.Initialize(db); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestIsolatedInstances(t *testing.T) {
+	for _, name := range []string{"db1", "db2"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := New(Config{DBName: name, Registerer: prometheus.NewRegistry(), InstrumentQueries: true, RefreshDuration: time.Millisecond, MinInterval: time.Millisecond})
+			db := openTestDB(t)
+			if err := db.Use(p); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(p.Stop)
+
+			server := httptest.NewServer(p.Handler())
+			defer server.Close()
+
+			for i := 0; i < 10; i++ {
+				db.Create(&testUser{Name: name})
+			}
+
+			response, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			other := "db1"
+			if name == other {
+				other = "db2"
+			}
+
+			if !strings.Contains(string(body), `db_name="`+name+`"`) || strings.Contains(string(body), `db_name="`+other+`"`) {
+				t.Fatalf("the metrics of %s aren't isolated:\n%s", name, body)
+			}
+
+			if total := testutil.ToFloat64(p.QueryMetrics.Total.WithLabelValues("create")); total != 10 {
+				t.Errorf("%v creates counted, expected 10", total)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	unixSocketPrefix    = "unix://"
+	maxPushRetryBackoff = time.Minute
+	unixIdleConnTimeout = 90 * time.Second // of the connections kept to the pushgateways listening on unix domain sockets, like http.DefaultTransport
+)
+
+func (p *Prometheus) startPush() {
+	p.pushOnce.Do(func() {
+		interval := time.Duration(p.Config.PushInterval) * time.Second
+		if interval == 0 {
+			interval = p.Config.refreshDuration()
+		}
+
+		if interval < p.Config.MinInterval {
+			p.logWarn("gorm:prometheus push interval %s is shorter than %s, the pushgateway is pushed to that often", interval, p.Config.MinInterval)
+		}
+
+		p.mu.Lock()
+		ctx := p.ctx
+		p.mu.Unlock()
+
+		if ctx == nil {
+			return
+		}
+
+		for _, addr := range p.Config.pushAddrs() {
+			addr := addr
+			p.every(interval, true, func() { // a loop per pushgateway so that one being down doesn't delay the pushes to the others
+				p.pushed(addr, p.pushWithRetry(ctx, addr))
+			})
+
+			p.onStop(func() {
+				if p.Config.DeleteOnShutdown {
+					if err := p.newPusher(addr).Delete(); err != nil {
+						p.logError("gorm:prometheus delete err: %v", err)
+					}
+				} else {
+					p.pushed(addr, p.push(addr))
+				}
+			})
+		}
+	})
+}
+
+// Push pushes the metrics to the pushgateways once now, e.g. at the end of a batch job, whether or not the periodic pushes are running
+func (p *Prometheus) Push() error {
+	if p.db() == nil || p.pluginMetrics() == nil {
+		return errors.New("gorm:prometheus the plugin must be initialized before pushing")
+	}
+
+	addrs := p.Config.pushAddrs()
+	if len(addrs) == 0 {
+		return errors.New("gorm:prometheus Push requires PushAddr or PushAddrs")
+	}
+
+	var errs error
+	for _, addr := range addrs {
+		err := p.push(addr)
+		p.pushed(addr, err)
+		errs = errors.Join(errs, err)
+	}
+	return errs
+}
+
+// push pushes the current collectors to the pushgateway at addr
+func (p *Prometheus) push(addr string) error {
+	registry := prometheus.NewRegistry()
+	for _, collector := range p.Collectors() {
+		if err := registry.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	pusher := p.newPusher(addr).Gatherer(withoutLabels(registry, p.pushGrouping()))
+	if p.Config.PushUseAdd {
+		return pusher.Add()
+	}
+	return pusher.Push()
+}
+
+// pushed records the outcome of a push
+func (p *Prometheus) pushed(addr string, err error) {
+	key := "push to " + addr
+	if err != nil {
+		p.pluginMetrics().PushErrors.Inc()
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			p.logFailure(key, "gorm:prometheus push timed out after %s: %v", p.Config.pushTimeout(), err)
+			return
+		}
+		p.logFailure(key, "gorm:prometheus push err: %v", err)
+		return
+	}
+	p.pluginMetrics().LastPush.SetToCurrentTime()
+	p.recovered(key)
+}
+
+// pushWithRetry pushes to addr, retrying up to PushRetries times with an exponential backoff until ctx is done
+func (p *Prometheus) pushWithRetry(ctx context.Context, addr string) error {
+	err := p.push(addr)
+	for retry := uint32(0); err != nil && retry < p.Config.PushRetries; retry++ {
+		delay := p.Config.PushRetryBackoff << retry
+		if delay <= 0 || delay > maxPushRetryBackoff {
+			delay = maxPushRetryBackoff
+		}
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) // jitter so that a fleet doesn't retry in lockstep
+
+		if p.isFailing("push to "+addr) && !p.Config.LogRepeatedErrors {
+			p.logInfo("gorm:prometheus push to %s err, retrying in %s: %v", addr, delay, err)
+		} else {
+			p.logWarn("gorm:prometheus push to %s err, retrying in %s: %v", addr, delay, err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-p.clock.After(delay):
+		}
+		err = p.push(addr)
+	}
+	return err
+}
+
+// newPusher returns a pusher to addr configured by Config without collectors
+func (p *Prometheus) newPusher(addr string) *push.Pusher {
+	job := p.Config.PushJobName
+	if job == "" {
+		job = p.DBName
+	}
+
+	target, client := p.pushTarget(addr)
+	pusher := push.New(target, job)
+	if p.Config.PushUsername != "" {
+		pusher = pusher.BasicAuth(p.Config.PushUsername, p.Config.PushPassword)
+	}
+
+	timed := http.Client{} // a copy so that the timeout doesn't apply to the other uses of PushHTTPClient
+	if client != nil {
+		timed = *client
+	}
+	timed.Timeout = p.Config.pushTimeout()
+	pusher = pusher.Client(&timed)
+
+	for name, value := range p.pushGrouping() {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	return pusher
+}
+
+// pushGrouping returns the grouping labels of the pushgateway, PushGrouping and InstanceLabel
+func (p *Prometheus) pushGrouping() map[string]string {
+	grouping := make(map[string]string, len(p.Config.PushGrouping)+1)
+	if name := p.Config.InstanceLabel; name != "" {
+		grouping[name] = p.labels()[name]
+	}
+
+	for name, value := range p.Config.PushGrouping {
+		grouping[name] = value
+	}
+	return grouping
+}
+
+// withoutLabels returns a gatherer removing the grouping labels from the metrics of gatherer,
+// the pushgateway rejects the metrics with a grouping label and adds them back itself
+func withoutLabels(gatherer prometheus.Gatherer, grouping map[string]string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+		for _, family := range families {
+			for _, metric := range family.Metric {
+				labels := make([]*dto.LabelPair, 0, len(metric.Label)) // metric.Label may be shared with the collector
+				for _, label := range metric.Label {
+					if _, ok := grouping[label.GetName()]; !ok {
+						labels = append(labels, label)
+					}
+				}
+				metric.Label = labels
+			}
+		}
+		return families, err
+	})
+}
+
+// pushTarget returns the url and the http client to push to addr with, addr like unix:///path/to/socket is dialed over a unix domain socket
+func (p *Prometheus) pushTarget(addr string) (string, *http.Client) {
+	socket := strings.TrimPrefix(addr, unixSocketPrefix)
+	if socket == addr {
+		return addr, p.Config.PushHTTPClient
+	}
+
+	p.unixClientsMu.Lock()
+	defer p.unixClientsMu.Unlock()
+
+	client, ok := p.unixClients[socket]
+	if !ok {
+		client = &http.Client{}
+		if p.Config.PushHTTPClient != nil {
+			*client = *p.Config.PushHTTPClient
+		}
+
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+			IdleConnTimeout: unixIdleConnTimeout,
+		}
+
+		if p.unixClients == nil {
+			p.unixClients = map[string]*http.Client{}
+		}
+		p.unixClients[socket] = client
+	}
+
+	return "http://localhost", client
+}
+
+// closeUnixClients closes the idle connections of the clients of the unix domain sockets and forgets them, dialed again by the next push
+func (p *Prometheus) closeUnixClients() {
+	p.unixClientsMu.Lock()
+	defer p.unixClientsMu.Unlock()
+
+	for _, client := range p.unixClients {
+		client.CloseIdleConnections()
+	}
+	p.unixClients = nil
+}
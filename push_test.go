@@ -0,0 +1,185 @@
+package prometheus
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestPushTimeout(t *testing.T) {
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	for _, c := range []struct {
+		config   Config
+		expected time.Duration
+	}{
+		{Config{}, defaultPushTimeout},
+		{Config{PushHTTPClient: &http.Client{}}, defaultPushTimeout},
+		{Config{PushHTTPClient: client}, client.Timeout},
+		{Config{PushHTTPClient: client, PushTimeout: time.Second}, time.Second},
+	} {
+		if timeout := c.config.pushTimeout(); timeout != c.expected {
+			t.Errorf("push timeout %s, expected %s", timeout, c.expected)
+		}
+	}
+
+	hanging := make(chan struct{})
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hanging:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+	defer close(hanging)
+
+	p := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), RefreshDuration: time.Hour, PushAddr: gateway.URL, PushHTTPClient: client})
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	start := time.Now()
+	if err := p.Push(); err == nil {
+		t.Fatal("the push to a hanging pushgateway succeeded")
+	}
+
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("the push took %s, the Timeout of PushHTTPClient is %s", elapsed, client.Timeout)
+	}
+
+	if client.Timeout != 50*time.Millisecond {
+		t.Errorf("the Timeout of PushHTTPClient was changed to %s", client.Timeout)
+	}
+}
+
+func TestPushDuringStop(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	pool, err := openTestDB(t).DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDB(t)
+	if err := db.Use(&testResolver{global: &testResolverPools{sources: []gorm.ConnPool{pool}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4)) // Push and Stop overlap even on a single cpu
+
+	collector := gaugeCollector{prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_custom"})}
+	p := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), RefreshDuration: time.Hour, PushAddr: gateway.URL, MetricsCollector: []MetricsCollector{collector}})
+	for i := 0; i < 20; i++ {
+		if err := p.Initialize(db); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() { // the collectors of MetricsCollector and the resolver pools are read while Stop forgets them
+			defer close(done)
+			_ = p.Push()
+		}()
+		p.Stop()
+		<-done
+	}
+}
+
+func TestPushOnStop(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		config   Config
+		expected string
+	}{
+		{"push", Config{}, http.MethodPut},
+		{"add", Config{PushUseAdd: true}, http.MethodPost},
+		{"delete", Config{DeleteOnShutdown: true}, http.MethodDelete},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var methods []string
+			gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				methods = append(methods, r.Method)
+				mu.Unlock()
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer gateway.Close()
+
+			config := c.config
+			config.DBName, config.Registerer, config.RefreshDuration, config.PushAddr = "db1", prometheus.NewRegistry(), time.Hour, gateway.URL
+			p := New(config)
+			if err := openTestDB(t).Use(p); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Stop()
+
+			waitFor(t, "the push on Initialize", func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(methods) == 1
+			})
+			p.Stop()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(methods) != 2 || methods[1] != c.expected {
+				t.Errorf("requests %v to the pushgateway, expected a last %s on Stop", methods, c.expected)
+			}
+		})
+	}
+}
+
+func TestStopClosesUnixSocketConnections(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "pushgateway.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	gateway.Listener = listener
+	gateway.Start()
+	defer gateway.Close()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		db, err := gorm.Open(testDialector{}, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := NewWithContext(context.Background(), Config{
+			DBName:          "db1",
+			Registerer:      prometheus.NewRegistry(),
+			RefreshDuration: time.Hour,
+			PushAddr:        unixSocketPrefix + socket,
+		})
+		if err := db.Use(p); err != nil {
+			t.Fatal(err)
+		}
+
+		p.Stop() // pushes over a kept alive connection, closed by Stop
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	}
+
+	waitFor(t, "the goroutines of the unix socket connections to exit", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
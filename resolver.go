@@ -0,0 +1,137 @@
+package prometheus
+
+import (
+	"database/sql"
+	"reflect"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+const dbResolverPlugin = "gorm:db_resolver"
+
+// roles of the dbresolver connection pools, by the name of the field of the resolver of dbresolver holding them
+var resolverRoleFields = map[string]string{"sources": "source", "replicas": "replica"}
+
+// unknownResolverRole is the role of a connection pool missing from the sources and replicas of the resolvers
+const unknownResolverRole = "unknown"
+
+// connPoolCaller is implemented by the DBResolver of gorm.io/plugin/dbresolver, Call calls fc with each of its connection pools
+type connPoolCaller interface {
+	Call(fc func(connPool gorm.ConnPool) error) error
+}
+
+// resolverPool is a connection pool of dbresolver with its stats
+type resolverPool struct {
+	db    *sql.DB
+	role  string
+	stats *DBStats
+}
+
+// refreshResolverPools refreshes the stats of each connection pool of dbresolver, named gorm_dbresolver_* rather than gorm_dbstats_*
+// and labeled by their role, source or replica, and their index among the pools of that role in the order they are first seen,
+// it does nothing if dbresolver isn't used by the plugin's db
+func (p *Prometheus) refreshResolverPools() {
+	caller, ok := p.db().Config.Plugins[dbResolverPlugin].(connPoolCaller)
+	if !ok {
+		return
+	}
+
+	roles := resolverRoles(caller)
+	_ = caller.Call(func(connPool gorm.ConnPool) error {
+		role, ok := roles[poolAddress(connPool)]
+		if stmtDB, isStmtDB := connPool.(*gorm.PreparedStmtDB); isStmtDB {
+			connPool = stmtDB.ConnPool
+			if !ok {
+				role, ok = roles[poolAddress(connPool)]
+			}
+		}
+
+		if !ok {
+			role = unknownResolverRole
+		}
+
+		if db, ok := connPool.(*sql.DB); ok {
+			p.setStats(p.resolverPoolStats(db, role), db)
+		}
+		return nil
+	})
+}
+
+// resolverPoolStats returns the stats of the resolver connection pool db, creating them on first use with the next index of role
+func (p *Prometheus) resolverPoolStats(db *sql.DB, role string) *DBStats {
+	p.resolverPoolsMu.Lock()
+	defer p.resolverPoolsMu.Unlock()
+
+	index := 0
+	for _, pool := range p.resolverPools {
+		if pool.db == db { // called once per resolver by Call, for each of the tables it resolves
+			return pool.stats
+		}
+
+		if pool.role == role {
+			index++
+		}
+	}
+
+	labels := p.labels()
+	labels["role"] = role
+	labels["pool"] = strconv.Itoa(index)
+
+	stats, err := newStats(resolverStatsPrefix, labels, p.Config).register(p.register)
+	if err != nil {
+		p.logError("gorm:prometheus failed to register the stats of the dbresolver %s connection pool %s, got error: %v", role, labels["pool"], err)
+	}
+	p.resolverPools = append(p.resolverPools, resolverPool{db: db, role: role, stats: stats})
+	return stats
+}
+
+// resolverRoles returns the role of the connection pools of the resolvers of dbresolver by their address, read from the sources and
+// replicas fields of its global resolver and the resolvers of its tables, since Call doesn't tell them apart
+func resolverRoles(caller connPoolCaller) map[uintptr]string {
+	roles := map[uintptr]string{}
+	dbResolver := reflect.Indirect(reflect.ValueOf(caller))
+	if dbResolver.Kind() != reflect.Struct {
+		return roles
+	}
+
+	var resolvers []reflect.Value
+	if global := dbResolver.FieldByName("global"); global.IsValid() {
+		resolvers = append(resolvers, global)
+	}
+
+	if byTable := dbResolver.FieldByName("resolvers"); byTable.Kind() == reflect.Map {
+		for iter := byTable.MapRange(); iter.Next(); {
+			resolvers = append(resolvers, iter.Value())
+		}
+	}
+
+	for _, resolver := range resolvers {
+		resolver = reflect.Indirect(resolver)
+		if resolver.Kind() != reflect.Struct {
+			continue
+		}
+
+		for field, role := range resolverRoleFields {
+			pools := resolver.FieldByName(field)
+			if pools.Kind() != reflect.Slice {
+				continue
+			}
+
+			for i := 0; i < pools.Len(); i++ {
+				if pool := pools.Index(i); pool.Kind() == reflect.Interface && !pool.IsNil() && pool.Elem().Kind() == reflect.Ptr {
+					roles[pool.Elem().Pointer()] = role
+				}
+			}
+		}
+	}
+	return roles
+}
+
+// poolAddress returns the address of a connection pool, as found by resolverRoles
+func poolAddress(connPool gorm.ConnPool) uintptr {
+	if value := reflect.ValueOf(connPool); value.Kind() == reflect.Ptr {
+		return value.Pointer()
+	}
+	return 0
+}
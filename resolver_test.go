@@ -0,0 +1,123 @@
+package prometheus
+
+import (
+	"database/sql"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// testResolver is registered as gorm:db_resolver, shaped like the DBResolver of dbresolver and calling with its connection pools like it does
+type testResolver struct {
+	global    *testResolverPools
+	resolvers map[string]*testResolverPools
+}
+
+// testResolverPools is shaped like a resolver of dbresolver
+type testResolverPools struct {
+	sources, replicas []gorm.ConnPool
+}
+
+func (r *testResolver) Name() string {
+	return dbResolverPlugin
+}
+
+func (r *testResolver) Initialize(*gorm.DB) error {
+	return nil
+}
+
+func (r *testResolver) Call(fc func(connPool gorm.ConnPool) error) error {
+	resolvers := []*testResolverPools{r.global}
+	for _, resolver := range r.resolvers {
+		resolvers = append(resolvers, resolver)
+	}
+
+	for _, resolver := range resolvers {
+		if resolver == nil {
+			continue
+		}
+
+		for _, pool := range append(append([]gorm.ConnPool{}, resolver.sources...), resolver.replicas...) {
+			if err := fc(pool); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestResolverPools(t *testing.T) {
+	var pools []*sql.DB
+	for i := 0; i < 3; i++ {
+		pool, err := openTestDB(t).DB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools = append(pools, pool)
+	}
+	source, replica, tableReplica := pools[0], pools[1], pools[2]
+
+	registry := prometheus.NewRegistry()
+	p := New(Config{DBName: "db1", Registerer: registry})
+	db := openTestDB(t)
+	if err := db.Use(&testResolver{
+		global: &testResolverPools{sources: []gorm.ConnPool{source}, replicas: []gorm.ConnPool{replica}},
+		resolvers: map[string]*testResolverPools{ // the source is shared with the global resolver
+			"orders": {sources: []gorm.ConnPool{source}, replicas: []gorm.ConnPool{&gorm.PreparedStmtDB{ConnPool: tableReplica}}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	for i := 0; i < 2; i++ { // the labels of the pools are kept by the next refresh
+		if err := p.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+
+		var labeled []string
+		for _, metric := range gather(t, registry)["gorm_dbresolver_open_connections"].GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			labeled = append(labeled, labels["role"]+" "+labels["pool"])
+		}
+		sort.Strings(labeled)
+
+		if expected := []string{"replica 0", "replica 1", "source 0"}; !reflect.DeepEqual(labeled, expected) {
+			t.Errorf("pools %v, expected %v", labeled, expected)
+		}
+	}
+
+	if err := p.SetDBMaxIdleConns(replica, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if roles := labelValues(t, registry, "gorm_dbresolver_max_idle_connections", "role"); len(roles) != 1 || roles[0] != "replica" {
+		t.Errorf("max idle connections of the roles %v, expected only the replica it is set on", roles)
+	}
+
+	if families := gather(t, registry); families["gorm_dbstats_open_connections"] == nil {
+		t.Error("the db stats of the plugin's db aren't exposed")
+	}
+
+	pushed := prometheus.NewRegistry()
+	for _, collector := range p.Collectors() {
+		if err := pushed.Register(collector); err != nil {
+			t.Fatalf("collectors can't be pushed: %v", err)
+		}
+	}
+	gather(t, pushed)
+}
@@ -0,0 +1,242 @@
+package prometheus
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handler returns the http handler exposing the metrics of the plugin's registry, mount it on your own mux to serve metrics without StartServer
+func (p *Prometheus) Handler() http.Handler {
+	if p.Config.Registerer == nil && p.Config.HandlerOpts == nil && !p.Config.DisableCompression && !p.Config.EnableOpenMetrics {
+		return promhttp.Handler()
+	}
+
+	var opts promhttp.HandlerOpts // responses are gzipped if accepted by the scraper, unless disabled
+	if p.Config.HandlerOpts != nil {
+		opts = *p.Config.HandlerOpts
+	}
+	if p.Config.DisableCompression {
+		opts.DisableCompression = true
+	}
+
+	if p.Config.EnableOpenMetrics {
+		opts.EnableOpenMetrics = true
+	}
+	return promhttp.InstrumentMetricHandler(handlerRegisterer{p}, promhttp.HandlerFor(p.Gatherer(), opts))
+}
+
+// handlerRegisterer registers the metrics of the metrics handler with the plugin's registry, keeping track of them for Unregister
+type handlerRegisterer struct {
+	p *Prometheus
+}
+
+func (r handlerRegisterer) Register(collector prometheus.Collector) error {
+	registered, err := r.p.register(collector)
+	if err != nil {
+		return err
+	}
+
+	r.p.registeredMu.Lock()
+	found := false
+	for _, c := range r.p.handlerCollectors {
+		if c == registered {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		r.p.handlerCollectors = append(r.p.handlerCollectors, registered)
+	}
+	r.p.registeredMu.Unlock()
+
+	if registered != collector { // promhttp uses the existing collector
+		return prometheus.AlreadyRegisteredError{ExistingCollector: registered, NewCollector: collector}
+	}
+	return nil
+}
+
+func (r handlerRegisterer) MustRegister(collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := r.Register(collector); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r handlerRegisterer) Unregister(collector prometheus.Collector) bool {
+	return r.p.unregister(collector)
+}
+
+// registerHandlerCollectors registers the metrics of the metrics handlers again after the plugin was stopped
+func (p *Prometheus) registerHandlerCollectors() {
+	p.registeredMu.Lock()
+	collectors := append([]prometheus.Collector(nil), p.handlerCollectors...)
+	p.registeredMu.Unlock()
+
+	for _, collector := range collectors {
+		if _, err := p.register(collector); err != nil {
+			p.logError("gorm:prometheus failed to register the metrics of the metrics handler, got error: %v", err)
+		}
+	}
+}
+
+// listen binds the address of the http server, so that Initialize fails if it is already in use rather than only StartServerErr
+func (p *Prometheus) listen() error {
+	p.serverMu.Lock()
+	defer p.serverMu.Unlock()
+
+	if p.serverStarted || p.listener != nil {
+		return nil
+	}
+
+	addr := net.JoinHostPort(p.Config.HTTPServerAddr, strconv.Itoa(int(p.Config.HTTPServerPort)))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("gorm:prometheus failed to listen on %s: %w", addr, err)
+	}
+	p.listener = listener
+	return nil
+}
+
+// closeListener closes the address bound by listen if the http server wasn't started on it
+func (p *Prometheus) closeListener() {
+	p.serverMu.Lock()
+	defer p.serverMu.Unlock()
+
+	if p.listener != nil {
+		p.listener.Close()
+		p.listener = nil
+	}
+}
+
+// checkServeMux returns an error if another handler is registered at MetricsPath on ServeMux, which would make handleServeMux panic
+func (p *Prometheus) checkServeMux() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.muxHandled {
+		return nil
+	}
+
+	_, pattern := p.Config.ServeMux.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: p.Config.MetricsPath}})
+	if pattern == p.Config.MetricsPath {
+		return fmt.Errorf("gorm:prometheus a handler is already registered at %s on ServeMux", p.Config.MetricsPath)
+	}
+	return nil
+}
+
+// handleServeMux registers the metrics handler at MetricsPath on ServeMux once
+func (p *Prometheus) handleServeMux() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.muxHandled {
+		return
+	}
+	p.Config.ServeMux.Handle(p.Config.MetricsPath, p.Handler())
+	p.muxHandled = true
+}
+
+func (p *Prometheus) startServer() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.serverMu.Lock()
+	defer p.serverMu.Unlock()
+
+	if p.serverStarted || p.ctx == nil || p.listener == nil {
+		return
+	}
+	listener := p.listener
+	p.listener = nil
+
+	mux := http.NewServeMux()
+	mux.Handle(p.Config.MetricsPath, p.basicAuth(p.Handler()))
+	if p.Config.HealthPath != "" {
+		mux.HandleFunc(p.Config.HealthPath, p.health)
+	}
+	srv := &http.Server{Handler: mux, TLSConfig: p.Config.TLSConfig}
+	p.serverStarted = true
+
+	go func() {
+		var err error
+		if p.Config.TLSCertFile != "" || p.Config.TLSConfig != nil {
+			err = srv.ServeTLS(listener, p.Config.TLSCertFile, p.Config.TLSKeyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			p.logError("gorm:prometheus listen and serve err: %v", err)
+
+			select {
+			case p.serverErr <- err:
+			default:
+			}
+		}
+	}()
+
+	p.wg.Add(1)
+	go func(ctx context.Context) {
+		defer p.wg.Done()
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), p.Config.ServerShutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err == context.DeadlineExceeded {
+			p.logWarn("gorm:prometheus shutdown server timed out after %s, closing in-flight scrapes", p.Config.ServerShutdownTimeout)
+			srv.Close()
+		} else if err != nil {
+			p.logError("gorm:prometheus shutdown server err: %v", err)
+		}
+
+		p.serverMu.Lock()
+		p.serverStarted = false
+		p.serverMu.Unlock()
+	}(p.ctx)
+}
+
+// StartServerErr returns a channel receiving the error if the http server started by StartServer fails after Initialize bound its port
+func (p *Prometheus) StartServerErr() <-chan error {
+	return p.serverErr
+}
+
+// health responds 200 if the last refresh of the db stats of all the databases succeeded, 503 otherwise
+func (p *Prometheus) health(w http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&p.healthy) == 1 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// basicAuth requires the configured basic auth credentials on each request, if any
+func (p *Prometheus) basicAuth(handler http.Handler) http.Handler {
+	if p.Config.BasicAuthUsername == "" && p.Config.BasicAuthPassword == "" {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(p.Config.BasicAuthUsername)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(p.Config.BasicAuthPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
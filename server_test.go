@@ -0,0 +1,110 @@
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gorm.io/gorm"
+)
+
+func TestServeMux(t *testing.T) {
+	mux := http.NewServeMux()
+	first := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), ServeMux: mux})
+	db := openTestDB(t)
+	if err := db.Use(first); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+
+	first.Stop()
+	if err := first.Initialize(db); err != nil { // its own handler stays registered
+		t.Fatalf("Initialize after Stop: %v", err)
+	}
+
+	second := New(Config{DBName: "db2", Registerer: prometheus.NewRegistry(), ServeMux: mux})
+	if err := openTestDB(t).Use(second); err == nil {
+		second.Stop()
+		t.Fatal("a second plugin registered its handler at the same path")
+	}
+
+	third := New(Config{DBName: "db3", Registerer: prometheus.NewRegistry(), ServeMux: mux, MetricsPath: "/db3/metrics"})
+	if err := openTestDB(t).Use(third); err != nil {
+		t.Fatalf("a plugin at another path: %v", err)
+	}
+	defer third.Stop()
+
+	for _, path := range []string{"/metrics", "/db3/metrics"} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s responded %d", path, recorder.Code)
+		}
+	}
+}
+
+// testConnPool is a connection pool not backed by a *sql.DB, so that it doesn't provide db stats
+type testConnPool struct {
+	gorm.ConnPool
+}
+
+func TestHealthWithoutDBStats(t *testing.T) {
+	p := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), HealthPath: "/health"})
+	db := openTestDB(t)
+	db.ConnPool = testConnPool{db.ConnPool}
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	for i := 0; i < 2; i++ {
+		if err := p.Refresh(); err == nil {
+			t.Fatal("Refresh succeeded without db stats")
+		}
+	}
+
+	if failures := testutil.ToFloat64(p.DBStats.RefreshErrors); failures != 3 { // the refresh of Initialize and the two of Refresh
+		t.Errorf("%v refresh errors counted, expected 3", failures)
+	}
+
+	recorder := httptest.NewRecorder()
+	p.health(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("health responded %d without db stats", recorder.Code)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	p := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), BasicAuthUsername: "scraper", BasicAuthPassword: "secret"})
+	handler := p.basicAuth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, c := range []struct {
+		name               string
+		username, password string
+		expected           int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "scraper", "wrong", http.StatusUnauthorized},
+		{"wrong username", "other", "secret", http.StatusUnauthorized},
+		{"authorized", "scraper", "secret", http.StatusOK},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if c.username != "" || c.password != "" {
+			request.SetBasicAuth(c.username, c.password)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != c.expected {
+			t.Errorf("%s: responded %d, expected %d", c.name, recorder.Code, c.expected)
+		}
+
+		if challenge := recorder.Header().Get("WWW-Authenticate"); (c.expected == http.StatusUnauthorized) != (challenge != "") {
+			t.Errorf("%s: WWW-Authenticate %q", c.name, challenge)
+		}
+	}
+}
@@ -2,12 +2,28 @@ package prometheus
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"reflect"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	statsPrefix         = "gorm_dbstats_"    // of the names of the db stats
+	resolverStatsPrefix = "gorm_dbresolver_" // of the names of the db stats of the dbresolver connection pools, which have the role and pool labels on top of the labels of the plugin's db stats
 )
 
 type DBStats struct {
 	MaxOpenConnections prometheus.Gauge // Maximum number of open connections to the database.
+	MaxIdleConnections prometheus.Gauge // Maximum number of idle connections as set by Prometheus.SetMaxIdleConns or SetDBMaxIdleConns, not exported until set with them.
+
+	ConnMaxLifetime prometheus.Gauge // Maximum lifetime of the connections in seconds as set by Prometheus.SetConnMaxLifetime, 0 if unlimited, not exported until set with it.
+	ConnMaxIdleTime prometheus.Gauge // Maximum idle time of the connections in seconds as set by Prometheus.SetConnMaxIdleTime, 0 if unlimited, not exported until set with it.
 
 	// Pool status
 	OpenConnections prometheus.Gauge // The number of established connections both in use and idle.
@@ -15,79 +31,443 @@ type DBStats struct {
 	Idle            prometheus.Gauge // The number of idle connections.
 
 	// Counters
-	WaitCount         prometheus.Gauge // The total number of connections waited for.
-	WaitDuration      prometheus.Gauge // The total time blocked waiting for a new connection.
-	MaxIdleClosed     prometheus.Gauge // The total number of connections closed due to SetMaxIdleConns.
-	MaxLifetimeClosed prometheus.Gauge // The total number of connections closed due to SetConnMaxLifetime.
+	WaitCount         *Cumulative // The total number of connections waited for.
+	WaitDuration      *Cumulative // The total time blocked waiting for a new connection.
+	MaxIdleClosed     *Cumulative // The total number of connections closed due to SetMaxIdleConns.
+	MaxIdleTimeClosed *Cumulative // The total number of connections closed due to SetConnMaxIdleTime.
+	MaxLifetimeClosed *Cumulative // The total number of connections closed due to SetConnMaxLifetime.
+
+	WaitSeconds prometheus.Counter // The total time blocked waiting for a new connection in seconds, use it rather than WaitDuration with rate().
+
+	PoolUtilization prometheus.Gauge // InUse divided by MaxOpenConnections, 0 if unlimited, nil unless Config.PoolUtilization is true.
+
+	WaitSummary prometheus.Summary // The average wait per connection over each refresh in seconds, nil unless Config.WaitObjectives is set.
+
+	PreparedStatements prometheus.Gauge // The number of statements cached by gorm when PrepareStmt is enabled, only set for the plugin's db.
+
+	LastRefresh   prometheus.Gauge   // The unix timestamp of the last successful refresh.
+	RefreshErrors prometheus.Counter // The total number of refreshes failing to get the db stats.
+
+	mu               sync.Mutex
+	last             sql.DBStats   // the db stats of the previous Set, see Snapshot
+	limits           connLimits    // see setLimits
+	maxIdle          *int          // see setMaxIdle
+	lastWaitDuration time.Duration // WaitDuration of the previous Set
+	lastWaitCount    int64         // WaitCount of the previous Set
 }
 
-func newStats(labels map[string]string) *DBStats {
+// newStats returns the db stats with labels, named with prefix after Config.MetricPrefix
+func newStats(prefix string, labels map[string]string, config *Config) *DBStats {
 	stats := &DBStats{
 		MaxOpenConnections: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "gorm_dbstats_max_open_connections",
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "max_open_connections",
 			Help:        "Maximum number of open connections to the database.",
 			ConstLabels: labels,
 		}),
+		MaxIdleConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "max_idle_connections",
+			Help:        "Maximum number of idle connections to the database.",
+			ConstLabels: labels,
+		}),
+		ConnMaxLifetime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "conn_max_lifetime_seconds",
+			Help:        "Maximum lifetime of the connections to the database in seconds, 0 if unlimited.",
+			ConstLabels: labels,
+		}),
+		ConnMaxIdleTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "conn_max_idle_time_seconds",
+			Help:        "Maximum idle time of the connections to the database in seconds, 0 if unlimited.",
+			ConstLabels: labels,
+		}),
 		OpenConnections: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "gorm_dbstats_open_connections",
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "open_connections",
 			Help:        "The number of established connections both in use and idle.",
 			ConstLabels: labels,
 		}),
 		InUse: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "gorm_dbstats_in_use",
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "in_use",
 			Help:        "The number of connections currently in use.",
 			ConstLabels: labels,
 		}),
 		Idle: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "gorm_dbstats_idle",
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "idle",
 			Help:        "The number of idle connections.",
 			ConstLabels: labels,
 		}),
-		WaitCount: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "gorm_dbstats_wait_count",
+		WaitCount: newCumulative(prometheus.Opts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "wait_count",
 			Help:        "The total number of connections waited for.",
 			ConstLabels: labels,
 		}),
-		WaitDuration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "gorm_dbstats_wait_duration",
-			Help:        "The total time blocked waiting for a new connection.",
+		WaitDuration: newCumulative(prometheus.Opts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "wait_duration",
+			Help:        "The total time blocked waiting for a new connection in nanoseconds.",
 			ConstLabels: labels,
 		}),
-		MaxIdleClosed: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "gorm_dbstats_max_idle_closed",
+		MaxIdleClosed: newCumulative(prometheus.Opts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "max_idle_closed",
 			Help:        "The total number of connections closed due to SetMaxIdleConns.",
 			ConstLabels: labels,
 		}),
-		MaxLifetimeClosed: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "gorm_dbstats_max_lifetime_closed",
+		MaxIdleTimeClosed: newCumulative(prometheus.Opts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "max_idle_time_closed",
+			Help:        "The total number of connections closed due to SetConnMaxIdleTime.",
+			ConstLabels: labels,
+		}),
+		MaxLifetimeClosed: newCumulative(prometheus.Opts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "max_lifetime_closed",
 			Help:        "The total number of connections closed due to SetConnMaxLifetime.",
 			ConstLabels: labels,
 		}),
+		WaitSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "wait_seconds_total",
+			Help:        "The total time blocked waiting for a new connection in seconds.",
+			ConstLabels: labels,
+		}),
+		PreparedStatements: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "prepared_statements",
+			Help:        "The number of statements cached by gorm when PrepareStmt is enabled.",
+			ConstLabels: labels,
+		}),
+		LastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "last_refresh_timestamp_seconds",
+			Help:        "The unix timestamp of the last successful refresh.",
+			ConstLabels: labels,
+		}),
+		RefreshErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "refresh_errors_total",
+			Help:        "The total number of refreshes failing to get the db stats.",
+			ConstLabels: labels,
+		}),
+	}
+
+	if config.PoolUtilization {
+		stats.PoolUtilization = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "pool_utilization",
+			Help:        "The number of connections in use divided by the maximum number of open connections, 0 if unlimited.",
+			ConstLabels: labels,
+		})
 	}
 
-	for _, collector := range stats.Collectors() {
-		_ = prometheus.Register(collector)
+	if len(config.WaitObjectives) > 0 {
+		stats.WaitSummary = prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			Name:        config.MetricPrefix + prefix + "average_wait_seconds",
+			Help:        "The average time blocked waiting for a new connection over each refresh in seconds.",
+			ConstLabels: labels,
+			Objectives:  config.WaitObjectives,
+		})
+	}
+
+	if len(config.EnabledStats) > 0 {
+		stats.filter(config.EnabledStats)
 	}
 
 	return stats
 }
 
+// filter disables the collectors of stats not listed in enabled by field name
+func (stats *DBStats) filter(enabled []string) {
+	value := reflect.ValueOf(stats).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field, name := value.Field(i), value.Type().Field(i).Name
+		if !isCollectorField(field) {
+			continue
+		}
+
+		found := false
+		for _, n := range enabled {
+			if n == name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+}
+
+// validateStats returns an error if one of names isn't the field name of a DBStats collector
+func validateStats(names []string) error {
+	statsType := reflect.TypeOf(DBStats{})
+	for _, name := range names {
+		if field, ok := statsType.FieldByName(name); !ok || !field.Type.Implements(collectorType) {
+			return fmt.Errorf("gorm:prometheus unknown db stats %q", name)
+		}
+	}
+	return nil
+}
+
+// connLimits are the limits set on the connections of a db, which database/sql doesn't expose
+type connLimits struct {
+	maxLifetime *time.Duration // see ConnMaxLifetime, nil until set since database/sql doesn't tell the actual one
+	maxIdleTime *time.Duration // see ConnMaxIdleTime, nil until set
+}
+
+// setLimits records the limits set on the connections of the db, reported on the next Set
+func (stats *DBStats) setLimits(limits connLimits) {
+	stats.mu.Lock()
+	stats.limits = limits
+	stats.mu.Unlock()
+}
+
+// setMaxIdle records the maximum number of idle connections of the db, nil until set since database/sql doesn't tell the actual one,
+// reported on the next Set
+func (stats *DBStats) setMaxIdle(n *int) {
+	stats.mu.Lock()
+	stats.maxIdle = n
+	stats.mu.Unlock()
+}
+
+// Snapshot returns the db stats as of the last refresh, it is safe to call concurrently with the refresh
+func (stats *DBStats) Snapshot() sql.DBStats {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return stats.last
+}
+
 func (stats *DBStats) Set(dbStats sql.DBStats) {
-	stats.MaxOpenConnections.Set(float64(dbStats.MaxOpenConnections))
-	stats.OpenConnections.Set(float64(dbStats.OpenConnections))
-	stats.InUse.Set(float64(dbStats.InUse))
-	stats.Idle.Set(float64(dbStats.Idle))
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.last = dbStats
+	setGauge(stats.MaxOpenConnections, float64(dbStats.MaxOpenConnections))
+
+	if stats.maxIdle != nil {
+		maxIdle := *stats.maxIdle // database/sql lowers it to the maximum number of open connections
+		if dbStats.MaxOpenConnections > 0 && maxIdle > dbStats.MaxOpenConnections {
+			maxIdle = dbStats.MaxOpenConnections
+		}
+		setGauge(stats.MaxIdleConnections, float64(maxIdle))
+	}
+
+	if stats.limits.maxLifetime != nil {
+		setGauge(stats.ConnMaxLifetime, stats.limits.maxLifetime.Seconds())
+	}
+
+	if stats.limits.maxIdleTime != nil {
+		setGauge(stats.ConnMaxIdleTime, stats.limits.maxIdleTime.Seconds())
+	}
+	setGauge(stats.OpenConnections, float64(dbStats.OpenConnections))
+	setGauge(stats.InUse, float64(dbStats.InUse))
+	setGauge(stats.Idle, float64(dbStats.Idle))
 	stats.WaitCount.Set(float64(dbStats.WaitCount))
 	stats.WaitDuration.Set(float64(dbStats.WaitDuration))
 	stats.MaxIdleClosed.Set(float64(dbStats.MaxIdleClosed))
+	stats.MaxIdleTimeClosed.Set(float64(dbStats.MaxIdleTimeClosed))
 	stats.MaxLifetimeClosed.Set(float64(dbStats.MaxLifetimeClosed))
+
+	delta := dbStats.WaitDuration - stats.lastWaitDuration
+	if delta < 0 { // the db was reopened
+		delta = dbStats.WaitDuration
+	}
+
+	if stats.WaitSeconds != nil {
+		stats.WaitSeconds.Add(delta.Seconds())
+	}
+
+	count := dbStats.WaitCount - stats.lastWaitCount
+	if count < 0 { // the db was reopened
+		count = dbStats.WaitCount
+	}
+
+	if stats.WaitSummary != nil && count > 0 {
+		stats.WaitSummary.Observe(delta.Seconds() / float64(count))
+	}
+	stats.lastWaitDuration, stats.lastWaitCount = dbStats.WaitDuration, dbStats.WaitCount
+
+	if dbStats.MaxOpenConnections > 0 {
+		setGauge(stats.PoolUtilization, float64(dbStats.InUse)/float64(dbStats.MaxOpenConnections))
+	} else {
+		setGauge(stats.PoolUtilization, 0)
+	}
+
+	if stats.LastRefresh != nil {
+		stats.LastRefresh.SetToCurrentTime()
+	}
+}
+
+// setPreparedStatements sets the number of statements cached by connPool if it is the prepared statement store of gorm
+func (stats *DBStats) setPreparedStatements(connPool gorm.ConnPool) {
+	stmtDB, ok := connPool.(*gorm.PreparedStmtDB)
+	if !ok {
+		return
+	}
+
+	stmtDB.Mux.RLock()
+	size := len(stmtDB.Stmts)
+	stmtDB.Mux.RUnlock()
+	setGauge(stats.PreparedStatements, float64(size))
+}
+
+// refreshFailed counts a refresh failing to get the db stats
+func (stats *DBStats) refreshFailed() {
+	if stats.RefreshErrors != nil {
+		stats.RefreshErrors.Inc()
+	}
+}
+
+// setGauge sets the value of gauge unless it is disabled
+func setGauge(gauge prometheus.Gauge, value float64) {
+	if gauge != nil {
+		gauge.Set(value)
+	}
+}
+
+// register registers stats as a single collector, it returns the already registered stats if returned by register
+func (stats *DBStats) register(register func(prometheus.Collector) (prometheus.Collector, error)) (*DBStats, error) {
+	collector, err := register(stats)
+	if err != nil {
+		return stats, err
+	}
+
+	if existing, ok := collector.(*DBStats); ok {
+		return existing, nil
+	}
+	return stats, nil
 }
 
-//get collector in stats
+// get collector in stats, stats is a single collector of all its metrics for Collect to be consistent with Set
 func (stats *DBStats) Collectors() (collector []prometheus.Collector) {
-	dbStatsValue := reflect.ValueOf(*stats)
-	for i := 0; i < dbStatsValue.NumField(); i++ {
-		collector = append(collector, dbStatsValue.Field(i).Interface().(prometheus.Gauge))
+	return []prometheus.Collector{stats}
+}
+
+// Describe implements prometheus.Collector
+func (stats *DBStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range fieldCollectors(stats) {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector, it waits for the Set in progress and writes the metrics before the next one,
+// the registry writing them only after Collect returns, so that a scrape never observes half of a Set
+func (stats *DBStats) Collect(ch chan<- prometheus.Metric) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		for _, collector := range fieldCollectors(stats) {
+			if stats.unset(collector) {
+				continue
+			}
+			collector.Collect(metrics)
+		}
+		close(metrics)
+	}()
+
+	for metric := range metrics {
+		written := &dto.Metric{}
+		if err := metric.Write(written); err != nil {
+			ch <- prometheus.NewInvalidMetric(metric.Desc(), err)
+			continue
+		}
+		ch <- writtenMetric{desc: metric.Desc(), metric: written}
+	}
+}
+
+// unset reports whether collector is the gauge of a connection limit not set, whose 0 would read as unlimited or as no idle connection
+func (stats *DBStats) unset(collector prometheus.Collector) bool {
+	return (collector == stats.MaxIdleConnections && stats.maxIdle == nil) ||
+		(collector == stats.ConnMaxLifetime && stats.limits.maxLifetime == nil) ||
+		(collector == stats.ConnMaxIdleTime && stats.limits.maxIdleTime == nil)
+}
+
+// writtenMetric is a metric with the value it had when it was written
+type writtenMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+func (m writtenMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m writtenMetric) Write(out *dto.Metric) error {
+	out.Label = m.metric.Label
+	out.Gauge = m.metric.Gauge
+	out.Counter = m.metric.Counter
+	out.Summary = m.metric.Summary
+	out.Untyped = m.metric.Untyped
+	out.Histogram = m.metric.Histogram
+	out.TimestampMs = m.metric.TimestampMs
+	return nil
+}
+
+// registerFields registers the collectors in the fields of the struct pointed to by v,
+// replacing them with the already registered ones if returned by register, it returns the errors of the ones failing to register
+func registerFields(v interface{}, register func(prometheus.Collector) (prometheus.Collector, error)) (errs error) {
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if !isCollectorField(field) {
+			continue
+		}
+
+		collector, err := register(field.Interface().(prometheus.Collector))
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("gorm:prometheus failed to register %s: %w", value.Type().Field(i).Name, err))
+			continue
+		}
+
+		if existing := reflect.ValueOf(collector); existing.Type().AssignableTo(field.Type()) {
+			field.Set(existing)
+		}
+	}
+	return errs
+}
+
+// fieldCollectors returns the collectors in the fields of the struct pointed to by v
+func fieldCollectors(v interface{}) (collectors []prometheus.Collector) {
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Field(i); isCollectorField(field) {
+			collectors = append(collectors, field.Interface().(prometheus.Collector))
+		}
 	}
 	return
 }
+
+var collectorType = reflect.TypeOf((*prometheus.Collector)(nil)).Elem()
+
+// isCollectorField reports whether field is an exported non-nil collector
+func isCollectorField(field reflect.Value) bool {
+	return field.CanInterface() && field.Type().Implements(collectorType) && !field.IsNil()
+}
@@ -0,0 +1,241 @@
+package prometheus
+
+import (
+	"database/sql"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnLimitsAreKept(t *testing.T) {
+	p := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), ConstLabels: map[string]string{"color": "blue"}})
+	db := openTestDB(t)
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := p.SetMaxIdleConns(7); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SetConnMaxLifetime(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		if err := p.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := testutil.ToFloat64(p.DBStats.MaxIdleConnections); n != 7 {
+			t.Errorf("%s: max idle connections %v, expected 7", when, n)
+		}
+
+		if seconds := testutil.ToFloat64(p.DBStats.ConnMaxLifetime); seconds != 3600 {
+			t.Errorf("%s: conn max lifetime %v, expected 3600", when, seconds)
+		}
+	}
+	check("after the setters")
+
+	if err := p.SetLabel("color", "green"); err != nil {
+		t.Fatal(err)
+	}
+	check("after SetLabel")
+
+	p.Stop()
+	if err := p.Initialize(db); err != nil {
+		t.Fatal(err)
+	}
+	check("after Stop and Initialize")
+}
+
+func TestSetIsConsistentWithGather(t *testing.T) {
+	stats := newStats(statsPrefix, nil, &Config{})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(stats)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for n := 1; ; n++ { // every stat of a Set is n
+			select {
+			case <-done:
+				return
+			default:
+				stats.Set(sql.DBStats{MaxOpenConnections: n, OpenConnections: n, InUse: n, Idle: n, WaitCount: int64(n), MaxIdleClosed: int64(n), MaxLifetimeClosed: int64(n)})
+				runtime.Gosched() // let the scrapes in between the Sets on a single cpu
+			}
+		}
+	}()
+
+	names := []string{"open_connections", "in_use", "idle", "wait_count", "max_idle_closed", "max_lifetime_closed", "max_open_connections"}
+	for i := 0; i < 200; i++ {
+		families := gather(t, registry)
+		var values []float64
+		for _, name := range names {
+			metric := families[statsPrefix+name].GetMetric()[0]
+			if metric.GetGauge() != nil {
+				values = append(values, metric.GetGauge().GetValue())
+			} else {
+				values = append(values, metric.GetCounter().GetValue())
+			}
+		}
+
+		for i, value := range values {
+			if value != values[0] {
+				t.Fatalf("a scrape observed half of a Set: %s is %v, %s is %v", names[0], values[0], names[i], value)
+			}
+		}
+	}
+}
+
+func TestConnLifetimesAreExportedOnceSet(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p := New(Config{DBName: "db1", Registerer: registry})
+	if err := openTestDB(t).Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	families := gather(t, registry)
+	if families[statsPrefix+"conn_max_lifetime_seconds"] != nil || families[statsPrefix+"conn_max_idle_time_seconds"] != nil {
+		t.Fatal("the lifetimes are exported before they are set")
+	}
+
+	if err := p.SetConnMaxLifetime(0); err != nil { // unlimited
+		t.Fatal(err)
+	}
+
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	families = gather(t, registry)
+	if families[statsPrefix+"conn_max_lifetime_seconds"] == nil {
+		t.Error("the lifetime isn't exported once set")
+	}
+
+	if families[statsPrefix+"conn_max_idle_time_seconds"] != nil {
+		t.Error("the idle time is exported before it is set")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	p := New(Config{DBName: "db1", Registerer: prometheus.NewRegistry(), RefreshDuration: time.Hour, ConstLabels: map[string]string{"color": "blue"}})
+	if stats := p.Snapshot(); stats != (sql.DBStats{}) {
+		t.Errorf("snapshot %+v before Initialize, expected the zero value", stats)
+	}
+
+	db := openTestDB(t)
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(5)
+
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4)) // the snapshots overlap the replacements of the stats even on a single cpu
+
+	done := make(chan struct{})
+	go func() { // SetLabel and Initialize replace the stats while they are read
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if err := p.SetLabel("color", []string{"blue", "green"}[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if err := p.Initialize(db); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			if stats := p.Snapshot(); stats.MaxOpenConnections != 5 {
+				t.Errorf("snapshot %+v, expected 5 max open connections", stats)
+			}
+			return
+		default:
+			p.Snapshot()
+		}
+	}
+}
+
+func TestMaxIdleConnsAreExportedOnceSet(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p := New(Config{DBName: "db1", Registerer: registry})
+	db := openTestDB(t)
+	if err := db.Use(p); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	added, watched := openTestDB(t), openTestDB(t)
+	if err := p.AddDB("added", added); err != nil {
+		t.Fatal(err)
+	}
+
+	watchedDB, err := watched.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.WatchDB("watched", watchedDB); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if families := gather(t, registry); families[statsPrefix+"max_idle_connections"] != nil {
+		t.Fatal("the max idle connections are exported before they are set")
+	}
+
+	addedDB, err := added.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SetDBMaxIdleConns(addedDB, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SetDBMaxIdleConns(watchedDB, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	maxIdle := map[string]float64{}
+	for _, metric := range gather(t, registry)[statsPrefix+"max_idle_connections"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "db_name" {
+				maxIdle[label.GetValue()] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+
+	if len(maxIdle) != 2 || maxIdle["added"] != 4 || maxIdle["watched"] != 6 {
+		t.Errorf("max idle connections %v by db, expected 4 for added and 6 for watched only", maxIdle)
+	}
+
+	if err := p.SetDBMaxIdleConns(nil, 1); err == nil {
+		t.Error("SetDBMaxIdleConns succeeded without a db")
+	}
+}
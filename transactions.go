@@ -0,0 +1,91 @@
+package prometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// txConnPool wraps the connection pool of the plugin's db statements to count the transactions begun on it, the explicit ones of
+// Begin and Transaction as well as the default ones gorm wraps writes in, db.ConnPool is left untouched so that db.DB() still works
+type txConnPool struct {
+	gorm.ConnPool
+	p *Prometheus
+}
+
+// instrumentTransactions wraps the connection pool of the statements of db, once
+func (p *Prometheus) instrumentTransactions(db *gorm.DB) {
+	if db.Statement == nil || db.Statement.ConnPool == nil {
+		return
+	}
+
+	if _, ok := db.Statement.ConnPool.(*txConnPool); ok { // already wrapped by a previous Initialize
+		return
+	}
+	db.Statement.ConnPool = &txConnPool{ConnPool: db.Statement.ConnPool, p: p}
+}
+
+// BeginTx begins a transaction on the wrapped connection pool, returning it wrapped to count its commit or rollback
+func (pool *txConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	var tx gorm.ConnPool
+	switch beginner := pool.ConnPool.(type) {
+	case gorm.TxBeginner:
+		sqlTx, err := beginner.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		tx = sqlTx
+	case gorm.ConnPoolBeginner:
+		connPool, err := beginner.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		tx = connPool
+	default:
+		return nil, gorm.ErrInvalidTransaction
+	}
+
+	committer, ok := tx.(gorm.TxCommitter)
+	if !ok {
+		return tx, nil
+	}
+
+	pool.p.countTransaction("begin")
+	return &txConn{ConnPool: tx, committer: committer, p: pool.p}, nil
+}
+
+// txConn is a transaction begun by txConnPool
+type txConn struct {
+	gorm.ConnPool
+	committer gorm.TxCommitter
+	p         *Prometheus
+}
+
+// Commit commits the transaction, a failed commit is counted as a rollback, the transaction isn't committed
+func (tx *txConn) Commit() error {
+	err := tx.committer.Commit()
+	if err == nil {
+		tx.p.countTransaction("commit")
+	} else {
+		tx.p.countTransaction("rollback")
+	}
+	return err
+}
+
+// Rollback rolls the transaction back, the rollback Transaction does after a failed commit isn't counted twice
+func (tx *txConn) Rollback() error {
+	err := tx.committer.Rollback()
+	if !errors.Is(err, sql.ErrTxDone) {
+		tx.p.countTransaction("rollback")
+	}
+	return err
+}
+
+// countTransaction counts a transaction by outcome, nothing is counted before Initialize
+func (p *Prometheus) countTransaction(outcome string) {
+	if metrics := p.queryMetrics(); metrics != nil {
+		metrics.Transactions.WithLabelValues(outcome).Inc()
+	}
+}